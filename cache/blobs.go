@@ -13,6 +13,7 @@ import (
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/flightcontrol"
+	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/util/winlayers"
 	digest "github.com/opencontainers/go-digest"
 	imagespecidentity "github.com/opencontainers/image-spec/identity"
@@ -441,16 +442,19 @@ func ensureCompression(ctx context.Context, ref *immutableRef, comp compression.
 		}).Unlazy(ctx); err != nil {
 			return nil, err
 		}
+		// recompressing a large layer is not free; surface it in the
+		// progress stream instead of looking like a hang
+		report := progress.OneOff(ctx, fmt.Sprintf("converting layer %s to %s", desc.Digest.Encoded()[:12], comp.Type))
 		newDesc, err := layerConvertFunc(ctx, ref.cm.ContentStore, desc)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to convert")
+			return nil, report(errors.Wrapf(err, "failed to convert"))
 		}
 
 		// Start to track converted layer
 		if err := ref.linkBlob(ctx, *newDesc); err != nil {
-			return nil, errors.Wrapf(err, "failed to add compression blob")
+			return nil, report(errors.Wrapf(err, "failed to add compression blob"))
 		}
-		return nil, nil
+		return nil, report(nil)
 	})
 	return err
 }
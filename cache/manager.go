@@ -1182,7 +1182,7 @@ func (cm *cacheManager) prune(ctx context.Context, ch chan client.UsageInfo, opt
 		}
 		if size == sizeUnknown {
 			// calling size will warm cache for next call
-			if _, err := cr.size(ctx); err != nil {
+			if _, err := cr.Size(ctx); err != nil {
 				return err
 			}
 		}
@@ -1421,7 +1421,7 @@ func (cm *cacheManager) DiskUsage(ctx context.Context, opt client.DiskUsageInfo)
 						d.Size = 0
 						return nil
 					}
-					s, err := ref.size(ctx)
+					s, err := ref.Size(ctx)
 					if err != nil {
 						return err
 					}
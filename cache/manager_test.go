@@ -473,7 +473,7 @@ func TestSnapshotExtract(t *testing.T) {
 	snap2, err := cm.GetByBlob(ctx, desc2, snap)
 	require.NoError(t, err)
 
-	size, err := snap2.(*immutableRef).size(ctx)
+	size, err := snap2.Size(ctx)
 	require.NoError(t, err)
 	require.Equal(t, int64(len(b2)), size)
 
@@ -628,7 +628,7 @@ func TestExtractOnMutable(t *testing.T) {
 
 	require.Equal(t, false, !snap2.(*immutableRef).getBlobOnly())
 
-	size, err := snap2.(*immutableRef).size(ctx)
+	size, err := snap2.Size(ctx)
 	require.NoError(t, err)
 	require.Equal(t, int64(len(b2)), size)
 
@@ -2064,7 +2064,7 @@ func TestMergeOp(t *testing.T) {
 		snap, err := active.Commit(ctx)
 		require.NoError(t, err)
 		baseRefs = append(baseRefs, snap)
-		size, err := snap.(*immutableRef).size(ctx)
+		size, err := snap.Size(ctx)
 		require.NoError(t, err)
 		require.EqualValues(t, 8192, size)
 	}
@@ -2095,7 +2095,7 @@ func TestMergeOp(t *testing.T) {
 	require.True(t, merge1.(*immutableRef).getCommitted())
 	_, err = merge1.Mount(ctx, true, nil)
 	require.NoError(t, err)
-	size1, err := merge1.(*immutableRef).size(ctx)
+	size1, err := merge1.Size(ctx)
 	require.NoError(t, err)
 	require.EqualValues(t, 4096, size1) // hardlinking means all but the first snapshot doesn't take up space
 	checkDiskUsage(ctx, t, cm, 7, 0)
@@ -2105,7 +2105,7 @@ func TestMergeOp(t *testing.T) {
 	require.True(t, merge2.(*immutableRef).getCommitted())
 	_, err = merge2.Mount(ctx, true, nil)
 	require.NoError(t, err)
-	size2, err := merge2.(*immutableRef).size(ctx)
+	size2, err := merge2.Size(ctx)
 	require.NoError(t, err)
 	require.EqualValues(t, 4096, size2)
 	checkDiskUsage(ctx, t, cm, 8, 0)
@@ -2123,7 +2123,7 @@ func TestMergeOp(t *testing.T) {
 	require.NoError(t, merge2.Release(ctx))
 	_, err = merge3.Mount(ctx, true, nil)
 	require.NoError(t, err)
-	size3, err := merge3.(*immutableRef).size(ctx)
+	size3, err := merge3.Size(ctx)
 	require.NoError(t, err)
 	require.EqualValues(t, 4096, size3)
 	require.Len(t, merge3.(*immutableRef).mergeParents, 6)
@@ -64,6 +64,8 @@ type RefMetadata interface {
 	GetLayerType() string
 	SetLayerType(string) error
 
+	GetChainID() digest.Digest
+
 	GetRecordType() client.UsageRecordType
 	SetRecordType(client.UsageRecordType) error
 
@@ -278,6 +280,13 @@ func (md *cacheMetadata) getChainID() digest.Digest {
 	return digest.Digest(md.GetString(keyChainID))
 }
 
+// GetChainID returns the snapshot chain ID, which identifies the ref's
+// content independently of the ref itself. Consumers outside the cache
+// package can use it to detect refs backed by identical snapshots.
+func (md *cacheMetadata) GetChainID() digest.Digest {
+	return md.getChainID()
+}
+
 func (md *cacheMetadata) queueBlob(str digest.Digest) error {
 	return md.queueValue(keyBlob, str, "")
 }
@@ -43,6 +43,7 @@ type Ref interface {
 	Mountable
 	RefMetadata
 	Release(context.Context) error
+	Size(ctx context.Context) (int64, error)
 	IdentityMapping() *idtools.IdentityMapping
 	DescHandler(digest.Digest) *DescHandler
 }
@@ -318,7 +319,7 @@ func (cr *cacheRecord) viewSnapshotID() string {
 	return cr.getSnapshotID() + "-view"
 }
 
-func (cr *cacheRecord) size(ctx context.Context) (int64, error) {
+func (cr *cacheRecord) Size(ctx context.Context) (int64, error) {
 	// this expects that usage() is implemented lazily
 	s, err := cr.sizeG.Do(ctx, cr.ID(), func(ctx context.Context) (interface{}, error) {
 		cr.mu.Lock()
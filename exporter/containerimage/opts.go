@@ -2,8 +2,11 @@ package containerimage
 
 import (
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/containerd/containerd/images"
+
 	cacheconfig "github.com/moby/buildkit/cache/config"
 	"github.com/moby/buildkit/exporter/util/epoch"
 	"github.com/moby/buildkit/exporter/util/multiplatform"
@@ -18,13 +21,34 @@ const (
 	keyCompressionLevel = "compression-level"
 	keyForceCompression = "force-compression"
 	keyOCITypes         = "oci-mediatypes"
-	keyBuildInfo        = "buildinfo"
-	keyBuildInfoAttrs   = "buildinfo-attrs"
+
+	// keyLayerMediaType is an exporter option forcing all layers to a
+	// specific OCI or Docker schema2 layer media type. The media type
+	// selects the compression codec and the manifest flavor; layers whose
+	// existing type differs are re-encoded with the selected compression
+	// settings. Takes precedence over the compression option.
+	keyLayerMediaType = "layer-mediatype"
+	keyBuildInfo      = "buildinfo"
+	keyBuildInfoAttrs = "buildinfo-attrs"
 
 	// preferNondistLayersKey is an exporter option which can be used to mark a layer as non-distributable if the layer reference was
 	// already found to use a non-distributable media type.
 	// When this option is not set, the exporter will change the media type of the layer to a distributable one.
 	keyPreferNondistLayers = "prefer-nondist-layers"
+
+	// keyMediaTypePreference is an exporter option holding an ordered,
+	// comma-separated list of layer media types. When a layer already
+	// exists in the cache in one of the listed encodings, the first
+	// available one is exported instead of re-encoding; layers cached in
+	// none of the listed types are exported as-is. Unlike layer-mediatype
+	// this never triggers recompression.
+	keyMediaTypePreference = "mediatype-preference"
+
+	// keySquash is an exporter option flattening all layers into a single
+	// one before the manifest is written. The squashed layer is recomputed
+	// from the final snapshot, so it cannot preserve non-distributable
+	// layers and conflicts with prefer-nondist-layers.
+	keySquash = "squash"
 )
 
 type ImageCommitOpts struct {
@@ -36,6 +60,11 @@ type ImageCommitOpts struct {
 	Annotations    AnnotationsGroup
 	Epoch          *time.Time
 	MultiPlatform  *bool
+	LayerMediaType string
+	// MediaTypePreference is the validated, ordered media type list from
+	// mediatype-preference.
+	MediaTypePreference []string
+	Squash              bool
 }
 
 func (c *ImageCommitOpts) Load(opt map[string]string) (map[string]string, error) {
@@ -74,6 +103,25 @@ func (c *ImageCommitOpts) Load(opt map[string]string) (map[string]string, error)
 			c.RefCfg.Compression.Level = &v
 		case keyForceCompression:
 			err = parseBoolWithDefault(&c.RefCfg.Compression.Force, k, v, true)
+		case keyLayerMediaType:
+			if _, err2 := compression.FromMediaType(v); err2 != nil {
+				err = errors.Wrapf(err2, "invalid value for %s", keyLayerMediaType)
+				break
+			}
+			c.LayerMediaType = v
+		case keyMediaTypePreference:
+			for _, mt := range strings.Split(v, ",") {
+				mt = strings.TrimSpace(mt)
+				if mt == "" {
+					err = errors.Errorf("empty entry in %s: %s", keyMediaTypePreference, v)
+					break
+				}
+				if _, err2 := compression.FromMediaType(mt); err2 != nil {
+					err = errors.Wrapf(err2, "invalid entry %q in %s", mt, keyMediaTypePreference)
+					break
+				}
+				c.MediaTypePreference = append(c.MediaTypePreference, mt)
+			}
 		case keyOCITypes:
 			err = parseBoolWithDefault(&c.OCITypes, k, v, true)
 		case keyBuildInfo:
@@ -82,6 +130,8 @@ func (c *ImageCommitOpts) Load(opt map[string]string) (map[string]string, error)
 			err = parseBoolWithDefault(&c.BuildInfoAttrs, k, v, false)
 		case keyPreferNondistLayers:
 			err = parseBool(&c.RefCfg.PreferNonDistributable, k, v)
+		case keySquash:
+			err = parseBoolWithDefault(&c.Squash, k, v, true)
 		default:
 			rest[k] = v
 		}
@@ -91,6 +141,19 @@ func (c *ImageCommitOpts) Load(opt map[string]string) (map[string]string, error)
 		}
 	}
 
+	if c.LayerMediaType != "" {
+		if len(c.MediaTypePreference) > 0 {
+			return nil, errors.Errorf("%s cannot be combined with %s: one forces a single re-encoded type, the other picks among cached encodings", keyMediaTypePreference, keyLayerMediaType)
+		}
+		if err := c.applyLayerMediaType(); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Squash && c.RefCfg.PreferNonDistributable {
+		return nil, errors.Errorf("%s cannot be combined with %s: squashing recomputes every layer so non-distributable layers cannot be preserved", keySquash, keyPreferNondistLayers)
+	}
+
 	if c.RefCfg.Compression.Type.OnlySupportOCITypes() {
 		c.EnableOCITypes(c.RefCfg.Compression.Type.String())
 	}
@@ -104,6 +167,27 @@ func (c *ImageCommitOpts) Load(opt map[string]string) (map[string]string, error)
 	return rest, nil
 }
 
+// applyLayerMediaType translates the validated layer-mediatype value into
+// the compression type, manifest flavor and distributability settings it
+// implies. It runs after all options are parsed so it wins regardless of
+// map iteration order, and turns on force-compression so layers that do
+// not already match are re-encoded.
+func (c *ImageCommitOpts) applyLayerMediaType() error {
+	ct, err := compression.FromMediaType(c.LayerMediaType)
+	if err != nil {
+		return errors.Wrapf(err, "invalid value for %s", keyLayerMediaType)
+	}
+	c.RefCfg.Compression.Type = ct
+	if strings.HasPrefix(c.LayerMediaType, "application/vnd.oci.") {
+		c.EnableOCITypes(keyLayerMediaType + "=" + c.LayerMediaType)
+	}
+	if images.IsNonDistributable(c.LayerMediaType) {
+		c.RefCfg.PreferNonDistributable = true
+	}
+	c.EnableForceCompression(keyLayerMediaType + "=" + c.LayerMediaType)
+	return nil
+}
+
 func (c *ImageCommitOpts) EnableOCITypes(reason string) {
 	if !c.OCITypes {
 		message := "forcibly turning on oci-mediatype mode"
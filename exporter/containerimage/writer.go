@@ -19,6 +19,7 @@ import (
 	"github.com/moby/buildkit/exporter/attestation"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/exporter/util/epoch"
+	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/snapshot"
 	"github.com/moby/buildkit/solver"
@@ -120,7 +121,7 @@ func (ic *ImageWriter) Commit(ctx context.Context, inp *exporter.Source, session
 			}
 		}
 
-		remotes, err := ic.exportLayers(ctx, opts.RefCfg, session.NewGroup(sessionID), ref)
+		remotes, err := ic.exportLayers(ctx, opts.RefCfg, opts.MediaTypePreference, session.NewGroup(sessionID), ref)
 		if err != nil {
 			return nil, err
 		}
@@ -179,7 +180,7 @@ func (ic *ImageWriter) Commit(ctx context.Context, inp *exporter.Source, session
 		refs = append(refs, r)
 	}
 
-	remotes, err := ic.exportLayers(ctx, opts.RefCfg, session.NewGroup(sessionID), refs...)
+	remotes, err := ic.exportLayers(ctx, opts.RefCfg, opts.MediaTypePreference, session.NewGroup(sessionID), refs...)
 	if err != nil {
 		return nil, err
 	}
@@ -319,7 +320,7 @@ func (ic *ImageWriter) Commit(ctx context.Context, inp *exporter.Source, session
 	return &idxDesc, nil
 }
 
-func (ic *ImageWriter) exportLayers(ctx context.Context, refCfg cacheconfig.RefConfig, s session.Group, refs ...cache.ImmutableRef) ([]solver.Remote, error) {
+func (ic *ImageWriter) exportLayers(ctx context.Context, refCfg cacheconfig.RefConfig, preference []string, s session.Group, refs ...cache.ImmutableRef) ([]solver.Remote, error) {
 	attr := []attribute.KeyValue{
 		attribute.String("exportLayers.compressionType", refCfg.Compression.Type.String()),
 		attribute.Bool("exportLayers.forceCompression", refCfg.Compression.Force),
@@ -340,6 +341,12 @@ func (ic *ImageWriter) exportLayers(ctx context.Context, refCfg cacheconfig.RefC
 				return
 			}
 			eg.Go(func() error {
+				if len(preference) > 0 {
+					if remote := ic.pickPreferredRemote(ctx, ref, refCfg, preference, s); remote != nil {
+						out[i] = *remote
+						return nil
+					}
+				}
 				remotes, err := ref.GetRemotes(ctx, true, refCfg, false, s)
 				if err != nil {
 					return err
@@ -356,6 +363,28 @@ func (ic *ImageWriter) exportLayers(ctx context.Context, refCfg cacheconfig.RefC
 	return out, err
 }
 
+// pickPreferredRemote returns the first cached encoding of ref's layer
+// chain matching the ordered media type preference, or nil when none of
+// the preferred encodings already exist. The lookup never creates new
+// blobs, so no layer is recompressed.
+func (ic *ImageWriter) pickPreferredRemote(ctx context.Context, ref cache.ImmutableRef, refCfg cacheconfig.RefConfig, preference []string, s session.Group) *solver.Remote {
+	for _, mt := range preference {
+		ct, err := compression.FromMediaType(mt)
+		if err != nil {
+			continue
+		}
+		cfg := refCfg
+		cfg.Compression.Type = ct
+		cfg.Compression.Force = false
+		remotes, err := ref.GetRemotes(ctx, false, cfg, true, s)
+		if err != nil || len(remotes) < 2 {
+			continue
+		}
+		return remotes[1]
+	}
+	return nil
+}
+
 func (ic *ImageWriter) commitDistributionManifest(ctx context.Context, opts *ImageCommitOpts, ref cache.ImmutableRef, config []byte, remote *solver.Remote, annotations *Annotations, inlineCache []byte, buildInfo []byte, epoch *time.Time, sg session.Group) (*ocispecs.Descriptor, *ocispecs.Descriptor, error) {
 	if len(config) == 0 {
 		var err error
@@ -375,6 +404,13 @@ func (ic *ImageWriter) commitDistributionManifest(ctx context.Context, opts *Ima
 		return nil, nil, err
 	}
 
+	if opts.Squash {
+		remote, history, err = ic.squashImageLayers(ctx, remote, history, ref, opts, sg)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	config, err = patchImageConfig(config, remote.Descriptors, history, inlineCache, buildInfo, epoch)
 	if err != nil {
 		return nil, nil, err
@@ -460,6 +496,73 @@ func (ic *ImageWriter) commitDistributionManifest(ctx context.Context, opts *Ima
 	}, &configDesc, nil
 }
 
+// squashImageLayers replaces the layer chain with a single layer computed
+// by diffing the final snapshot against an empty lower. History collapses
+// to one entry; its creation time honors opts.Epoch. File timestamps inside
+// the squashed layer come from the snapshot itself, which the build has
+// already rewritten when a source epoch was set.
+func (ic *ImageWriter) squashImageLayers(ctx context.Context, remote *solver.Remote, history []ocispecs.History, ref cache.ImmutableRef, opts *ImageCommitOpts, sg session.Group) (*solver.Remote, []ocispecs.History, error) {
+	if len(remote.Descriptors) <= 1 {
+		return remote, history, nil
+	}
+	if ref == nil {
+		return nil, nil, errors.Errorf("cannot squash layers without a snapshot reference")
+	}
+
+	mountable, err := ref.Mount(ctx, true, sg)
+	if err != nil {
+		return nil, nil, err
+	}
+	mounts, release, err := mountable.Mount()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	done := progress.OneOff(ctx, fmt.Sprintf("squashing %d layers", len(remote.Descriptors)))
+
+	// the containerd differ only understands the OCI layer media types;
+	// the descriptor is converted to the docker flavor below if needed
+	desc, err := ic.opt.Differ.Compare(ctx, nil, mounts,
+		diff.WithMediaType(ocispecs.MediaTypeImageLayerGzip),
+		diff.WithReference("squash-"+identity.NewID()),
+	)
+	if err != nil {
+		return nil, nil, done(errors.Wrap(err, "failed to compute squashed layer"))
+	}
+
+	// the differ records the uncompressed digest as a content store label
+	// only; copy it to the annotation the config patching relies on
+	info, err := ic.opt.ContentStore.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, nil, done(err)
+	}
+	diffID, ok := info.Labels["containerd.io/uncompressed"]
+	if !ok {
+		return nil, nil, done(errors.Errorf("squashed layer %s is missing uncompressed digest", desc.Digest))
+	}
+	if desc.Annotations == nil {
+		desc.Annotations = map[string]string{}
+	}
+	desc.Annotations["containerd.io/uncompressed"] = diffID
+	done(nil)
+
+	created := time.Now().UTC()
+	if opts.Epoch != nil {
+		created = *opts.Epoch
+	}
+	history = []ocispecs.History{{
+		Created:   &created,
+		CreatedBy: "squash",
+		Comment:   "buildkit.exporter.image.v0",
+	}}
+
+	return &solver.Remote{
+		Descriptors: compression.ConvertAllLayerMediaTypes(opts.OCITypes, desc),
+		Provider:    ic.opt.ContentStore,
+	}, history, nil
+}
+
 func (ic *ImageWriter) commitAttestationsManifest(ctx context.Context, opts *ImageCommitOpts, p exptypes.Platform, target string, statements []intoto.Statement) (*ocispecs.Descriptor, error) {
 	var (
 		manifestType = ocispecs.MediaTypeImageManifest
@@ -63,7 +63,11 @@ func (e *localExporter) Resolve(ctx context.Context, opt map[string]string) (exp
 	for k, v := range opt {
 		switch k {
 		case keyAttestationPrefix:
-			i.opts.AttestationPrefix = v
+			prefix, err := ValidateAttestationPrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			i.opts.AttestationPrefix = prefix
 		}
 	}
 
@@ -126,6 +130,10 @@ func (e *localExporterInstance) Export(ctx context.Context, inp *exporter.Source
 
 	now := time.Now().Truncate(time.Second)
 
+	if len(inp.Refs) > 0 {
+		e.opts.Mounts = NewSharedMounts()
+	}
+
 	export := func(ctx context.Context, k string, ref cache.ImmutableRef, attestations []result.Attestation) func() error {
 		return func() error {
 			outputFS, cleanup, err := CreateFS(ctx, sessionID, k, ref, inp.Refs, attestations, now, e.opts)
@@ -153,7 +161,7 @@ func (e *localExporterInstance) Export(ctx context.Context, inp *exporter.Source
 				}
 			}
 
-			progress := NewProgressHandler(ctx, lbl)
+			progress := NewProgressHandler(ctx, lbl, ProgressHandlerOpt{Platform: k})
 			if err := filesync.CopyToCaller(ctx, outputFS, caller, progress); err != nil {
 				return err
 			}
@@ -184,23 +192,53 @@ func (e *localExporterInstance) Export(ctx context.Context, inp *exporter.Source
 	return nil, nil
 }
 
-func NewProgressHandler(ctx context.Context, id string) func(int, bool) {
-	limiter := rate.NewLimiter(rate.Every(100*time.Millisecond), 1)
+// ProgressHandlerOpt configures NewProgressHandler.
+type ProgressHandlerOpt struct {
+	// Platform attributes the events to a platform; may be empty.
+	Platform string
+	// Total, when non-zero, is reported as the expected byte count so
+	// that clients can render a percentage.
+	Total int64
+	// Interval is the minimum time between intermediate updates,
+	// coalescing high-frequency writes. Zero means the default of 100ms
+	// (10 updates per second). The final update is always delivered.
+	Interval time.Duration
+}
+
+// NewProgressHandler writes rate-limited transfer progress for id, both as
+// a human-readable Status and as a machine-readable ExportEvent under a
+// derived id.
+func NewProgressHandler(ctx context.Context, id string, opt ProgressHandlerOpt) func(int, bool) {
+	interval := opt.Interval
+	if interval == 0 {
+		interval = 100 * time.Millisecond
+	}
+	limiter := rate.NewLimiter(rate.Every(interval), 1)
 	pw, _, _ := progress.NewFromContext(ctx)
 	now := time.Now()
 	st := progress.Status{
 		Started: &now,
 		Action:  "transferring",
+		Total:   int(opt.Total),
+	}
+	ev := progress.ExportEvent{
+		Phase:      "export",
+		Platform:   opt.Platform,
+		BytesTotal: opt.Total,
 	}
 	pw.Write(id, st)
+	pw.Write(id+"#events", ev)
 	return func(s int, last bool) {
 		if last || limiter.Allow() {
 			st.Current = s
+			ev.BytesDone = int64(s)
 			if last {
 				now := time.Now()
 				st.Completed = &now
+				ev.Done = true
 			}
 			pw.Write(id, st)
+			pw.Write(id+"#events", ev)
 			if last {
 				pw.Close()
 			}
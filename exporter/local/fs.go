@@ -8,10 +8,13 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/pkg/idtools"
 	intoto "github.com/in-toto/in-toto-golang/in_toto"
+	slsa02 "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
 	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/exporter/attestation"
 	"github.com/moby/buildkit/session"
@@ -24,12 +27,166 @@ import (
 	fstypes "github.com/tonistiigi/fsutil/types"
 )
 
+// inlineProvenanceName is the well-known file the InlineProvenance option
+// writes the SLSA provenance predicate to.
+const inlineProvenanceName = "provenance.json"
+
 type CreateFSOpts struct {
-	Epoch             *time.Time
+	Epoch *time.Time
+	// ClampMtime only rewrites mtimes that are later than Epoch, leaving
+	// older files untouched, matching SOURCE_DATE_EPOCH clamping semantics.
+	// Without it, Epoch overwrites every mtime.
+	ClampMtime        bool
 	AttestationPrefix string
 	MultiPlatform     *bool
+	// IncludePatterns/ExcludePatterns filter the walked filesystem with
+	// fsutil-style patterns, relative to each ref's root.
+	IncludePatterns []string
+	ExcludePatterns []string
+	// SkipAttestations leaves attestation files out of the produced
+	// filesystem. Used when attestations are dropped or delivered
+	// separately at export time.
+	SkipAttestations bool
+	// InlineProvenance additionally writes the SLSA provenance predicate
+	// as a plain provenance.json at the root of the tree (or of each
+	// platform subtree), for consumers that want the predicate without
+	// parsing in-toto envelopes. The attestation files themselves are
+	// unaffected.
+	InlineProvenance bool
+	// Mounts, when set, shares read-only ref mounts between CreateFS
+	// calls of the same export. Refs backed by the same snapshot chain
+	// are mounted only once.
+	Mounts *SharedMounts
+}
+
+// SharedMounts deduplicates read-only ref mounts within a single export.
+// Refs with the same chain ID share one underlying mount; the mount is
+// released once the last user's cleanup runs.
+type SharedMounts struct {
+	mu     sync.Mutex
+	mounts map[string]*sharedMount
+}
+
+type sharedMount struct {
+	src     string
+	idmap   *idtools.IdentityMapping
+	unmount func() error
+	err     error
+	ready   chan struct{}
+	users   int
+}
+
+func NewSharedMounts() *SharedMounts {
+	return &SharedMounts{mounts: map[string]*sharedMount{}}
+}
+
+// mount returns a mounted source directory for ref, reusing an existing
+// mount of the same snapshot chain when possible. The returned cleanup
+// must be called exactly once; the underlying mount is unmounted when all
+// users have released it.
+func (sm *SharedMounts) mount(ctx context.Context, sessionID string, ref cache.ImmutableRef) (string, *idtools.IdentityMapping, func() error, error) {
+	key := string(ref.GetChainID())
+	if key == "" {
+		key = ref.ID()
+	}
+
+	sm.mu.Lock()
+	m, ok := sm.mounts[key]
+	if !ok {
+		m = &sharedMount{ready: make(chan struct{})}
+		sm.mounts[key] = m
+	}
+	m.users++
+	sm.mu.Unlock()
+
+	if !ok {
+		mount, err := ref.Mount(ctx, true, session.NewGroup(sessionID))
+		if err != nil {
+			m.err = err
+		} else {
+			lm := snapshot.LocalMounter(mount)
+			m.src, err = lm.Mount()
+			if err != nil {
+				m.err = err
+			} else {
+				m.idmap = mount.IdentityMapping()
+				m.unmount = lm.Unmount
+			}
+		}
+		close(m.ready)
+	}
+
+	select {
+	case <-m.ready:
+	case <-ctx.Done():
+		sm.release(key, m)
+		return "", nil, nil, ctx.Err()
+	}
+	if m.err != nil {
+		sm.release(key, m)
+		return "", nil, nil, m.err
+	}
+	return m.src, m.idmap, func() error { return sm.release(key, m) }, nil
+}
+
+func (sm *SharedMounts) release(key string, m *sharedMount) error {
+	sm.mu.Lock()
+	m.users--
+	last := m.users == 0
+	if last {
+		delete(sm.mounts, key)
+	}
+	sm.mu.Unlock()
+	if last && m.unmount != nil {
+		return m.unmount()
+	}
+	return nil
+}
+
+// ValidateAttestationPrefix validates and normalizes the attestation-prefix
+// exporter option. The prefix must be a relative path without traversal or
+// empty segments; redundant trailing slashes are collapsed.
+func ValidateAttestationPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(prefix, "/") {
+		return "", errors.Errorf("attestation prefix %q must be a relative path", prefix)
+	}
+	trailing := strings.HasSuffix(prefix, "/")
+	trimmed := strings.TrimRight(prefix, "/")
+	for _, seg := range strings.Split(trimmed, "/") {
+		switch seg {
+		case "":
+			return "", errors.Errorf("attestation prefix %q contains an empty path segment", prefix)
+		case ".", "..":
+			return "", errors.Errorf("attestation prefix %q must not contain path traversal", prefix)
+		}
+	}
+	if trailing {
+		return trimmed + "/", nil
+	}
+	return prefix, nil
+}
+
+// applyEpoch rewrites a stat's mtime according to the epoch settings. With
+// clamp only mtimes later than the epoch are pulled back; otherwise the
+// epoch overwrites the mtime unconditionally.
+func applyEpoch(st *fstypes.Stat, epoch *time.Time, clamp bool) {
+	if epoch == nil {
+		return
+	}
+	if !clamp || st.ModTime > epoch.UnixNano() {
+		st.ModTime = epoch.UnixNano()
+	}
 }
 
+// CreateFS returns a filesystem view of ref for export. The ref's snapshot
+// is mounted read-only and wrapped in an fsutil.FS that walks the mount in
+// place, so consumers (tar writers, file sync) stream file contents
+// straight from the mount without any intermediate copy; the only disk
+// cost of an export is the mount itself. The returned cleanup unmounts the
+// snapshot and must be called after the walk is finished.
 func CreateFS(ctx context.Context, sessionID string, k string, ref cache.ImmutableRef, refs map[string]cache.ImmutableRef, attestations []result.Attestation, defaultTime time.Time, opt CreateFSOpts) (fsutil.FS, func() error, error) {
 	var cleanup func() error
 	var src string
@@ -41,6 +198,11 @@ func CreateFS(ctx context.Context, sessionID string, k string, ref cache.Immutab
 			return nil, nil, err
 		}
 		cleanup = func() error { return os.RemoveAll(src) }
+	} else if opt.Mounts != nil {
+		src, idmap, cleanup, err = opt.Mounts.mount(ctx, sessionID, ref)
+		if err != nil {
+			return nil, nil, err
+		}
 	} else {
 		mount, err := ref.Mount(ctx, true, session.NewGroup(sessionID))
 		if err != nil {
@@ -59,7 +221,10 @@ func CreateFS(ctx context.Context, sessionID string, k string, ref cache.Immutab
 		cleanup = lm.Unmount
 	}
 
-	walkOpt := &fsutil.WalkOpt{}
+	walkOpt := &fsutil.WalkOpt{
+		IncludePatterns: opt.IncludePatterns,
+		ExcludePatterns: opt.ExcludePatterns,
+	}
 	var idMapFunc func(p string, st *fstypes.Stat) fsutil.MapResult
 
 	if idmap != nil {
@@ -82,80 +247,130 @@ func CreateFS(ctx context.Context, sessionID string, k string, ref cache.Immutab
 		if idMapFunc != nil {
 			res = idMapFunc(p, st)
 		}
-		if opt.Epoch != nil {
-			st.ModTime = opt.Epoch.UnixNano()
-		}
+		applyEpoch(st, opt.Epoch, opt.ClampMtime)
 		return res
 	}
 
 	outputFS := fsutil.NewFS(src, walkOpt)
+	if !opt.SkipAttestations {
+		attFS, err := CreateAttestationsFS(ctx, sessionID, refs, attestations, outputFS, defaultTime, opt)
+		if err != nil {
+			return nil, nil, err
+		}
+		if attFS != nil {
+			outputFS = staticfs.NewMergeFS(outputFS, attFS)
+		}
+	}
+
+	return outputFS, cleanup, nil
+}
+
+// CreateAttestationsFS builds a filesystem containing only the in-toto
+// attestation statements for outputFS. The subject digests are computed by
+// walking outputFS, which must not already contain the attestation files.
+// It returns nil when there are no inline attestations.
+func CreateAttestationsFS(ctx context.Context, sessionID string, refs map[string]cache.ImmutableRef, attestations []result.Attestation, outputFS fsutil.FS, defaultTime time.Time, opt CreateFSOpts) (fsutil.FS, error) {
 	attestations = attestation.Filter(attestations, nil, map[string][]byte{
 		result.AttestationInlineOnlyKey: []byte(strconv.FormatBool(true)),
 	})
-	attestations, err = attestation.Unbundle(ctx, session.NewGroup(sessionID), refs, attestations)
+	attestations, err := attestation.Unbundle(ctx, session.NewGroup(sessionID), refs, attestations)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if len(attestations) > 0 {
-		subjects := []intoto.Subject{}
-		err = outputFS.Walk(ctx, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.Mode().IsRegular() {
-				return nil
-			}
-			f, err := outputFS.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			d := digest.Canonical.Digester()
-			if _, err := io.Copy(d.Hash(), f); err != nil {
-				return err
-			}
-			subjects = append(subjects, intoto.Subject{
-				Name:   path,
-				Digest: result.ToDigestMap(d.Digest()),
-			})
+	if len(attestations) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, len(attestations))
+	nameSet := map[string]struct{}{}
+	for i, att := range attestations {
+		name := opt.AttestationPrefix + path.Base(att.Path)
+		if _, ok := nameSet[name]; ok {
+			return nil, errors.Errorf("duplicate attestation path name %s", name)
+		}
+		nameSet[name] = struct{}{}
+		names[i] = name
+	}
+	if opt.InlineProvenance {
+		if _, ok := nameSet[inlineProvenanceName]; ok {
+			return nil, errors.Errorf("attestation path %s collides with the inline provenance file", inlineProvenanceName)
+		}
+		nameSet[inlineProvenanceName] = struct{}{}
+	}
+
+	subjects := []intoto.Subject{}
+	err = outputFS.Walk(ctx, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := nameSet[path]; ok {
+			return errors.Errorf("attestation path %s collides with a file in the export", path)
+		}
+		if !info.Mode().IsRegular() {
 			return nil
-		})
+		}
+		f, err := outputFS.Open(path)
 		if err != nil {
-			return nil, nil, err
+			return err
+		}
+		defer f.Close()
+		d := digest.Canonical.Digester()
+		if _, err := io.Copy(d.Hash(), f); err != nil {
+			return err
 		}
+		subjects = append(subjects, intoto.Subject{
+			Name:   path,
+			Digest: result.ToDigestMap(d.Digest()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		stmts, err := attestation.MakeInTotoStatements(ctx, session.NewGroup(sessionID), refs, attestations, subjects)
-		if err != nil {
-			return nil, nil, err
+	stmts, err := attestation.MakeInTotoStatements(ctx, session.NewGroup(sessionID), refs, attestations, subjects)
+	if err != nil {
+		return nil, err
+	}
+	stmtFS := staticfs.NewFS()
+
+	addFile := func(name string, dt []byte) {
+		st := fstypes.Stat{
+			Mode:    0600,
+			Path:    name,
+			ModTime: defaultTime.UnixNano(),
+		}
+		if opt.Epoch != nil {
+			st.ModTime = opt.Epoch.UnixNano()
 		}
-		stmtFS := staticfs.NewFS()
+		stmtFS.Add(name, st, dt)
+	}
 
-		names := map[string]struct{}{}
-		for i, stmt := range stmts {
-			dt, err := json.Marshal(stmt)
-			if err != nil {
-				return nil, nil, errors.Wrap(err, "failed to marshal attestation")
-			}
+	for i, stmt := range stmts {
+		dt, err := json.Marshal(stmt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal attestation")
+		}
+		addFile(names[i], dt)
+	}
 
-			name := opt.AttestationPrefix + path.Base(attestations[i].Path)
-			if _, ok := names[name]; ok {
-				return nil, nil, errors.Errorf("duplicate attestation path name %s", name)
+	if opt.InlineProvenance {
+		found := false
+		for _, stmt := range stmts {
+			if stmt.PredicateType != slsa02.PredicateSLSAProvenance {
+				continue
 			}
-			names[name] = struct{}{}
-
-			st := fstypes.Stat{
-				Mode:    0600,
-				Path:    name,
-				ModTime: defaultTime.UnixNano(),
+			if found {
+				return nil, errors.Errorf("multiple provenance attestations cannot be inlined as %s", inlineProvenanceName)
 			}
-			if opt.Epoch != nil {
-				st.ModTime = opt.Epoch.UnixNano()
+			found = true
+			dt, err := json.Marshal(stmt.Predicate)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to marshal provenance predicate")
 			}
-			stmtFS.Add(name, st, dt)
+			addFile(inlineProvenanceName, dt)
 		}
-
-		outputFS = staticfs.NewMergeFS(outputFS, stmtFS)
 	}
 
-	return outputFS, cleanup, nil
+	return stmtFS, nil
 }
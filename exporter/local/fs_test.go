@@ -0,0 +1,126 @@
+package local
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	slsa02 "github.com/in-toto/in-toto-golang/in_toto/slsa_provenance/v0.2"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/solver/result"
+	"github.com/stretchr/testify/require"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+func TestCreateFSSkipAttestations(t *testing.T) {
+	atts := []result.Attestation{{
+		Kind: gatewaypb.AttestationKindInToto,
+		Path: "provenance.json",
+		InToto: result.InTotoAttestation{
+			PredicateType: "https://example.com/predicate",
+		},
+		ContentFunc: func() ([]byte, error) { return []byte("{}"), nil },
+	}}
+
+	walkNames := func(opts CreateFSOpts) []string {
+		outputFS, cleanup, err := CreateFS(context.TODO(), "", "", nil, nil, atts, time.Now(), opts)
+		require.NoError(t, err)
+		if cleanup != nil {
+			defer cleanup()
+		}
+		var names []string
+		require.NoError(t, outputFS.Walk(context.TODO(), func(p string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			names = append(names, p)
+			return nil
+		}))
+		return names
+	}
+
+	require.Equal(t, []string{"att.provenance.json"}, walkNames(CreateFSOpts{AttestationPrefix: "att."}))
+	require.Empty(t, walkNames(CreateFSOpts{AttestationPrefix: "att.", SkipAttestations: true}))
+}
+
+func TestCreateFSInlineProvenance(t *testing.T) {
+	atts := []result.Attestation{{
+		Kind: gatewaypb.AttestationKindInToto,
+		Path: "provenance.att.json",
+		InToto: result.InTotoAttestation{
+			PredicateType: slsa02.PredicateSLSAProvenance,
+		},
+		ContentFunc: func() ([]byte, error) { return []byte(`{"builder":{"id":"test"}}`), nil },
+	}}
+
+	epoch := time.Unix(1234, 0)
+	outputFS, cleanup, err := CreateFS(context.TODO(), "", "", nil, nil, atts, time.Now(), CreateFSOpts{
+		AttestationPrefix: "att.",
+		InlineProvenance:  true,
+		Epoch:             &epoch,
+	})
+	require.NoError(t, err)
+	if cleanup != nil {
+		defer cleanup()
+	}
+
+	var names []string
+	var mtime int64
+	require.NoError(t, outputFS.Walk(context.TODO(), func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		names = append(names, p)
+		if p == "provenance.json" {
+			mtime = info.ModTime().UnixNano()
+		}
+		return nil
+	}))
+	require.Equal(t, []string{"att.provenance.att.json", "provenance.json"}, names)
+	require.Equal(t, epoch.UnixNano(), mtime)
+
+	// the inline file carries the bare predicate, not the envelope
+	rc, err := outputFS.Open("provenance.json")
+	require.NoError(t, err)
+	dt, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.JSONEq(t, `{"builder":{"id":"test"}}`, string(dt))
+
+	// an attestation already claiming the well-known name is an error
+	atts[0].Path = "provenance.json"
+	_, cleanup, err = CreateFS(context.TODO(), "", "", nil, nil, atts, time.Now(), CreateFSOpts{InlineProvenance: true})
+	if cleanup != nil {
+		defer cleanup()
+	}
+	require.ErrorContains(t, err, "collides with the inline provenance")
+}
+
+func TestApplyEpoch(t *testing.T) {
+	epoch := time.Unix(1000, 0)
+	before := time.Unix(500, 0).UnixNano()
+	after := time.Unix(2000, 0).UnixNano()
+
+	st := &fstypes.Stat{ModTime: after}
+	applyEpoch(st, &epoch, false)
+	require.Equal(t, epoch.UnixNano(), st.ModTime)
+
+	st = &fstypes.Stat{ModTime: before}
+	applyEpoch(st, &epoch, false)
+	require.Equal(t, epoch.UnixNano(), st.ModTime)
+
+	// clamping pulls back future mtimes but leaves older ones untouched
+	st = &fstypes.Stat{ModTime: after}
+	applyEpoch(st, &epoch, true)
+	require.Equal(t, epoch.UnixNano(), st.ModTime)
+
+	st = &fstypes.Stat{ModTime: before}
+	applyEpoch(st, &epoch, true)
+	require.Equal(t, before, st.ModTime)
+
+	st = &fstypes.Stat{ModTime: after}
+	applyEpoch(st, nil, true)
+	require.Equal(t, after, st.ModTime)
+}
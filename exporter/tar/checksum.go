@@ -0,0 +1,78 @@
+package local
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checksumManifestName is the name of the per-file digest manifest entry
+// emitted at the root of the exported tree, or of each platform subtree,
+// when the checksums option is enabled.
+const checksumManifestName = "SHA256SUMS"
+
+// checksumCollector accumulates per-file digests while the tar entries are
+// written, so the manifest can be emitted last without re-reading any file.
+// Entry content is digested as it streams through writeTarEntry.
+type checksumCollector struct {
+	sums []checksumSum
+	h    hash.Hash
+	name string
+}
+
+type checksumSum struct {
+	name string
+	hex  string
+}
+
+// begin starts digesting the content of the named entry; the returned hash
+// must receive exactly the bytes written to the tar stream.
+func (c *checksumCollector) begin(name string) hash.Hash {
+	c.h = sha256.New()
+	c.name = name
+	return c.h
+}
+
+// commit records the digest started by the last begin call.
+func (c *checksumCollector) commit() {
+	c.sums = append(c.sums, checksumSum{name: c.name, hex: hex.EncodeToString(c.h.Sum(nil))})
+	c.h = nil
+}
+
+// writeManifest emits the manifest entry in the sha256sum(1) line format,
+// with names relative to prefix, placed at prefix itself so per-platform
+// subtrees each carry their own manifest. The manifest is written after all
+// other entries and is not part of its own listing.
+func (c *checksumCollector) writeManifest(tw *tar.Writer, prefix string, opts writeTarOpts) error {
+	var sb strings.Builder
+	for _, s := range c.sums {
+		sb.WriteString(s.hex)
+		sb.WriteString("  ")
+		sb.WriteString(strings.TrimPrefix(s.name, prefix))
+		sb.WriteString("\n")
+	}
+	dt := []byte(sb.String())
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     prefix + checksumManifestName,
+		Mode:     0644,
+		ModTime:  opts.checksumMtime,
+		Size:     int64(len(dt)),
+	}
+	if opts.deterministic {
+		normalizeHeader(hdr)
+	}
+	if opts.format != tar.FormatUnknown {
+		hdr.Format = opts.format
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "failed to write checksum manifest header")
+	}
+	_, err := tw.Write(dt)
+	return errors.Wrapf(err, "failed to write checksum manifest")
+}
@@ -0,0 +1,167 @@
+package local
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// diffFS walks only the entries of target that differ from base, plus
+// OCI-style .wh. whiteout entries for paths that exist in base but not in
+// target, producing an incremental "update" tree that consumers apply over
+// the base to reconstruct the full export. The comparison is stat-based
+// (type, mode, ownership, size, mtime, link target); content changes that
+// leave all of those untouched are not detected. Parent directories of
+// changed entries are always included so the tree extracts cleanly.
+type diffFS struct {
+	base   fsutil.FS
+	target fsutil.FS
+}
+
+func newDiffFS(base, target fsutil.FS) fsutil.FS {
+	return &diffFS{base: base, target: target}
+}
+
+func (d *diffFS) Walk(ctx context.Context, fn filepath.WalkFunc) error {
+	baseStats := map[string]*types.Stat{}
+	if err := d.base.Walk(ctx, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat, ok := fi.Sys().(*types.Stat); ok {
+			baseStats[filepath.ToSlash(path)] = stat
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	type targetEntry struct {
+		path string
+		fi   os.FileInfo
+	}
+	var targets []targetEntry
+	targetStats := map[string]os.FileInfo{}
+	changed := map[string]bool{}
+	seen := map[string]bool{}
+
+	if err := d.target.Walk(ctx, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		p := filepath.ToSlash(path)
+		targets = append(targets, targetEntry{path: p, fi: fi})
+		targetStats[p] = fi
+		seen[p] = true
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			changed[p] = true
+			return nil
+		}
+		if b, ok := baseStats[p]; !ok || !sameStat(b, stat) {
+			changed[p] = true
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// deletions become whiteout entries; their parents must be included
+	// even when otherwise unchanged
+	var whiteouts []string
+	for p := range baseStats {
+		if !seen[p] {
+			whiteouts = append(whiteouts, p)
+		}
+	}
+	sort.Strings(whiteouts)
+	// a deleted child inside a deleted directory is covered by the
+	// directory's own whiteout
+	whiteouts = dropShadowedWhiteouts(whiteouts)
+
+	markParents := func(p string) {
+		for {
+			p = parentDir(p)
+			if p == "" || changed[p] {
+				return
+			}
+			changed[p] = true
+		}
+	}
+	for p := range changed {
+		markParents(p)
+	}
+	for _, p := range whiteouts {
+		markParents(p)
+	}
+
+	for _, e := range targets {
+		if !changed[e.path] {
+			continue
+		}
+		if err := fn(e.path, e.fi, nil); err != nil {
+			return err
+		}
+	}
+	for _, p := range whiteouts {
+		wh := filepath.ToSlash(filepath.Join(filepath.Dir(p), whiteoutPrefix+filepath.Base(p)))
+		st := &types.Stat{
+			Path: wh,
+			Mode: 0600,
+		}
+		if b := baseStats[p]; b != nil {
+			st.ModTime = b.ModTime
+		}
+		if err := fn(wh, &fsutil.StatInfo{Stat: st}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *diffFS) Open(p string) (io.ReadCloser, error) {
+	return d.target.Open(p)
+}
+
+// sameStat reports whether two entries are equal at the metadata level.
+func sameStat(a, b *types.Stat) bool {
+	return a.Mode == b.Mode &&
+		a.Uid == b.Uid &&
+		a.Gid == b.Gid &&
+		a.Size_ == b.Size_ &&
+		a.ModTime == b.ModTime &&
+		a.Linkname == b.Linkname &&
+		a.Devmajor == b.Devmajor &&
+		a.Devminor == b.Devminor
+}
+
+// parentDir returns the parent path of p within the walk namespace, or ""
+// at the root.
+func parentDir(p string) string {
+	dir := filepath.ToSlash(filepath.Dir(p))
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+// dropShadowedWhiteouts removes whiteouts whose ancestor is itself whited
+// out; the input must be sorted.
+func dropShadowedWhiteouts(whiteouts []string) []string {
+	out := whiteouts[:0]
+	var last string
+	for _, p := range whiteouts {
+		if last != "" && strings.HasPrefix(p, last+"/") {
+			continue
+		}
+		out = append(out, p)
+		last = p
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package local
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+)
+
+func TestDiffFS(t *testing.T) {
+	base := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "same"), []byte("same"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "modified"), []byte("old"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "sub", "deleted"), []byte("gone"), 0644))
+
+	target := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(target, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(target, "same"), []byte("same"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(target, "modified"), []byte("newer"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(target, "added"), []byte("new"), 0644))
+
+	// align the mtimes of the unchanged pair so the stat comparison sees
+	// them as equal
+	fi, err := os.Stat(filepath.Join(base, "same"))
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(filepath.Join(target, "same"), fi.ModTime(), fi.ModTime()))
+	fi, err = os.Stat(filepath.Join(base, "sub"))
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(filepath.Join(target, "sub"), fi.ModTime(), fi.ModTime()))
+
+	fs := newDiffFS(
+		fsutil.NewFS(base, &fsutil.WalkOpt{}),
+		fsutil.NewFS(target, &fsutil.WalkOpt{}),
+	)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{deterministic: true}))
+
+	entries := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		dt, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		entries[hdr.Name] = string(dt)
+	}
+
+	require.Equal(t, "new", entries["added"])
+	require.Equal(t, "newer", entries["modified"])
+	require.NotContains(t, entries, "same")
+	// the deletion is recorded as a whiteout, with its parent included
+	require.Contains(t, entries, "sub/")
+	require.Contains(t, entries, "sub/"+whiteoutPrefix+"deleted")
+	require.Empty(t, entries["sub/"+whiteoutPrefix+"deleted"])
+}
@@ -1,13 +1,29 @@
 package local
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/go-units"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/exporter"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
@@ -16,197 +32,3689 @@ import (
 	"github.com/moby/buildkit/exporter/util/multiplatform"
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/session/filesync"
+	"github.com/moby/buildkit/session/upload"
 	"github.com/moby/buildkit/solver/result"
+	"github.com/moby/buildkit/util/bklog"
 	"github.com/moby/buildkit/util/progress"
+	"github.com/moby/buildkit/util/staticfs"
+	"github.com/moby/patternmatcher"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
 	"github.com/tonistiigi/fsutil"
 	fstypes "github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
+	// attestationPrefixKey prefixes the names of attestation files. The
+	// prefix may contain a {platform} token, expanded per platform to the
+	// resolved platform directory name, so attestations stay co-located
+	// with their platform's rootfs in multi-platform exports. The
+	// expanded prefix is validated like a literal one.
 	attestationPrefixKey = "attestation-prefix"
 
+	// attestationPlatformPlaceholder is the token in attestation-prefix
+	// replaced with the resolved platform name.
+	attestationPlatformPlaceholder = "{platform}"
+
 	// preferNondistLayersKey is an exporter option which can be used to mark a layer as non-distributable if the layer reference was
 	// already found to use a non-distributable media type.
 	// When this option is not set, the exporter will change the media type of the layer to a distributable one.
+	// Preserving non-distributable media types takes precedence over
+	// recompression, so combining this with the compression options is
+	// rejected rather than silently re-encoding the layers.
 	preferNondistLayersKey = "prefer-nondist-layers"
+
+	// compressionKey is an exporter option to compress the tarball sent to the
+	// client. Supported values: "gzip", "zstd", "lz4". An empty value
+	// disables compression. Only a single compression may be selected.
+	// lz4 trades ratio for very fast encoding, for same-host exports
+	// where CPU matters more than the bytes on the wire.
+	compressionKey = "compression"
+
+	// compressionLevelKey is an exporter option to select the compression
+	// level for the codec chosen with compressionKey. Valid ranges are 1-9
+	// for gzip and 1-22 for zstd. When unset the codec default is used.
+	compressionLevelKey = "compression-level"
+
+	// compressionThreadsKey is an exporter option to compress with the
+	// given number of concurrent encoder threads. zstd supports this
+	// natively; gzip switches to a pgzip-style block-split encoder that
+	// compresses independent blocks in parallel, which scales roughly
+	// linearly with cores on large exports at the cost of a slightly
+	// larger output. Values above the available CPUs are capped. Requires
+	// compression to be set.
+	compressionThreadsKey = "compression-threads"
+
+	// zstdDictKey is an exporter option naming a session upload URL for a
+	// zstd dictionary blob to prime the encoder with. Sharing a dictionary
+	// across many similar exports improves ratios considerably. The
+	// resulting tarball can only be decompressed with the same dictionary.
+	// The dictionary is fetched and validated before any stream opens, so
+	// a bad dictionary fails the export up front. Requires
+	// compression=zstd.
+	zstdDictKey = "zstd-dict"
+
+	// deterministicKey is an exporter option that makes the produced tarball
+	// reproducible: entries are sorted lexicographically and header fields
+	// that vary between runs (uid/gid, uname/gname, access/change times) are
+	// normalized. Combine with source-date-epoch to also pin mtimes. The
+	// special value "strict" additionally fails the export on inputs that
+	// normalization cannot fix: sub-second mtimes without a pinned epoch,
+	// duplicate entry paths and special files.
+	deterministicKey = "deterministic"
+
+	// deterministicStrict is the deterministic value enabling the strict
+	// input checks.
+	deterministicStrict = "strict"
+
+	// outputTypeKey selects how the result is sent to the client: "tar"
+	// (default) streams a single tarball, "dir" syncs individual files into
+	// a directory on the client.
+	outputTypeKey = "output-type"
+
+	outputTypeTar = "tar"
+	outputTypeDir = "dir"
+
+	// splitSizeKey is an exporter option to split the tarball into multiple
+	// sequential parts of roughly the given size (accepts byte suffixes,
+	// e.g. "2GB"). Parts are only split between whole tar entries.
+	splitSizeKey = "split-size"
+
+	// exporterPartsKey and exporterPartSizesKey report the number of tar
+	// parts produced by split-size and their individual sizes (JSON array
+	// of bytes) in the export metadata.
+	exporterPartsKey     = "tarball.parts"
+	exporterPartSizesKey = "tarball.part-sizes"
+
+	// exporterPartKey is sent in each part's stream metadata so the
+	// filesync target can route the part to its own file and commit it
+	// when the stream closes. Parts are numbered from 0 in stream order.
+	exporterPartKey = "tarball.part"
+
+	// exporterPartsCompleteKey reports whether the part sequence is
+	// complete. Parts are committed on the client as their streams close,
+	// so when a split export is interrupted the finished parts survive and
+	// only the in-progress one is lost; the metadata then accompanies the
+	// error with this key set to "false" so a later export can resume
+	// part-by-part.
+	exporterPartsCompleteKey = "tarball.parts-complete"
+
+	// tarFormatKey is an exporter option to select the tar header format:
+	// "pax" (default), "gnu" or "ustar". PAX is required for long path
+	// names, large UIDs/GIDs and sub-second timestamps; GNU supports long
+	// names and large numeric fields but no extended records; ustar is the
+	// most portable but limits paths to 256 bytes and UIDs/GIDs to 2097151.
+	tarFormatKey = "tar-format"
+
+	// indexKey is an exporter option that adds an index.json entry at the
+	// root of multi-platform tarballs, mapping each exported platform to
+	// its subdirectory. When an epoch is pinned, each entry also records
+	// the platform's effective epoch (honoring per-platform overrides).
+	indexKey = "index"
+
+	indexFileName = "index.json"
+
+	// bomKey is an exporter option that adds a bom.json entry at the root
+	// of multi-platform tarballs, mapping each exported platform ID to
+	// the content digest of its subtree (computed by serializing the
+	// subtree as an uncompressed tar with the export's write options).
+	// Unlike index.json, which only ties platforms to directory names,
+	// the BOM ties them to content, so consumers can verify a subtree
+	// without trusting the directory layout. The entry's mtime follows
+	// the export epoch when one is pinned.
+	bomKey = "bom"
+
+	bomFileName = "bom.json"
+
+	// platformSeparatorKey is an exporter option to pick the character that
+	// replaces "/" in multi-platform subdirectory names (default "_").
+	platformSeparatorKey = "platform-separator"
+
+	// platformsKey is an exporter option with comma-separated platform
+	// specs that limits a multi-platform export to the requested subset.
+	// Requesting a platform that is not part of the result is an error.
+	platformsKey = "platforms"
+
+	// rootModeKey, rootUidKey and rootGidKey customize the header of the
+	// synthetic platform directory wrapping each exported tree, for
+	// consumers that are strict about top-level ownership. Mode is octal
+	// permission bits; defaults are 0755 owned by root.
+	rootModeKey = "root-mode"
+	rootUidKey  = "root-uid"
+	rootGidKey  = "root-gid"
+
+	// singlePlatformFlattenKey is an exporter option that drops the
+	// platform subdirectory when the (possibly filtered) result contains
+	// exactly one platform, producing a plain single-platform tarball.
+	singlePlatformFlattenKey = "single-platform-flatten"
+
+	// platformTemplateKey is an exporter option that names multi-platform
+	// subdirectories from a template over the platform fields, e.g.
+	// "{os}-{arch}{variant}". Supported placeholders: {os}, {arch},
+	// {variant}, {osversion}. Takes precedence over platform-separator.
+	platformTemplateKey = "platform-template"
+
+	// includeKey and excludeKey filter the exported filesystem with
+	// newline- or comma-separated fsutil-style patterns, applied relative
+	// to each platform's root.
+	includeKey = "include"
+	excludeKey = "exclude"
+
+	// preserveXattrsKey is an exporter option that includes extended
+	// attributes (e.g. SELinux labels, file capabilities) as PAX records
+	// in the tarball. Requires tar-format=pax.
+	preserveXattrsKey = "preserve-xattrs"
+
+	// preserveCapsKey preserves file capabilities (the security.capability
+	// extended attribute written by setcap) as PAX records even when
+	// preserve-xattrs is off. On directory output the attribute travels
+	// through the file sync protocol and is applied by the client sync
+	// target when it has the privilege to set capabilities; capsStrictKey
+	// rejects output modes where that application is best-effort.
+	preserveCapsKey = "preserve-caps"
+	capsStrictKey   = "caps-strict"
+
+	// pruneEmptyDirsKey is an exporter option that drops directories with
+	// no descendants from the tarball, recursively: a directory containing
+	// only other empty directories is pruned along with them. Directories
+	// that must stay exportable when empty (e.g. mount points) can be
+	// listed in keep-empty-dirs as comma or newline separated glob
+	// patterns.
+	pruneEmptyDirsKey = "prune-empty-dirs"
+	keepEmptyDirsKey  = "keep-empty-dirs"
+
+	// textEOLKey normalizes the line endings of text files as they are
+	// streamed into the tar: "lf" rewrites CRLF sequences to LF, "crlf"
+	// the other way around, "none" (default) leaves content untouched.
+	// Candidate files can be narrowed with text-eol-globs; files with a
+	// null byte in their leading bytes are treated as binary and skipped
+	// even when they match. Normalization rewrites file content, so entry
+	// sizes and any content digests differ from the source filesystem.
+	textEOLKey = "text-eol"
+
+	textEOLLF   = "lf"
+	textEOLCRLF = "crlf"
+	textEOLNone = "none"
+
+	// textEOLGlobsKey is a comma or newline separated list of patterns
+	// selecting which files text-eol applies to, e.g. "*.txt,*.md".
+	// Unset applies the normalization to every regular file that passes
+	// the binary sniff.
+	textEOLGlobsKey = "text-eol-globs"
+
+	// casefoldKey selects handling for case-insensitive extraction targets
+	// (macOS, Windows), where README and readme collide: "lower" rewrites
+	// all paths to lowercase, "detect" keeps paths untouched but fails the
+	// export when two entries collide under case folding, reporting both
+	// paths. Unset leaves paths as-is.
+	casefoldKey = "casefold"
+
+	casefoldLower  = "lower"
+	casefoldDetect = "detect"
+
+	// sparseKey is an exporter option that stores regular files containing
+	// holes as GNU sparse 1.0 tar members instead of expanding them to
+	// their full apparent size, which can shrink exports of disk images or
+	// preallocated databases dramatically. Holes are detected with
+	// SEEK_DATA/SEEK_HOLE on the mounted ref; filesystems that cannot
+	// report holes fall back to verbatim storage. The sparse map rides in
+	// pax extended headers, so this requires the pax (default) tar-format,
+	// and extraction needs a sparse-aware tar tool (GNU tar, bsdtar);
+	// others extract the compacted data without reassembling the holes.
+	sparseKey = "sparse"
+
+	// dedupHardlinksKey is an exporter option that detects regular files
+	// with identical content and writes subsequent copies as tar hardlink
+	// entries pointing at the first one. Saves space for trees with many
+	// duplicated files. Note that ustar limits link targets to 100 bytes;
+	// use the pax (default) or gnu tar-format for long paths.
+	dedupHardlinksKey = "dedup-hardlinks"
+
+	// chmodKey is an exporter option that overrides the permission bits of
+	// matching entries, as comma or newline separated pattern=mode pairs
+	// (e.g. **/*.sh=0755). Patterns use the same matching rules as include
+	// and exclude; when several rules match an entry the last one wins.
+	// Modes are octal and validated at resolve time.
+	chmodKey = "chmod"
+
+	// dedupContentKey is an exporter option that stores identical file
+	// content only once, whatever the output shape. Content-addressed
+	// formats like the OCI layout already do this by construction, since
+	// blobs are keyed by digest; for the plain tar stream it degrades to
+	// the hardlink rewriting of dedup-hardlinks. Digesting keeps one
+	// digest per unique regular file in memory for the duration of the
+	// export, on the order of a hundred bytes each, which can add up for
+	// trees with millions of files.
+	dedupContentKey = "dedup-content"
+
+	// symlinksKey selects how symlinks are serialized into the tarball:
+	// "preserve" (default) keeps them as symlink entries, "follow"
+	// dereferences them to their target's content (targets are resolved
+	// within the export only, with a loop guard), "error" fails the
+	// export if any symlink is present. Useful for extraction targets
+	// that cannot represent symlinks.
+	symlinksKey = "symlinks"
+
+	symlinksPreserve = "preserve"
+	symlinksFollow   = "follow"
+	symlinksError    = "error"
+
+	// syncKey waits for the client's directory target to fsync the
+	// received files before the export reports success, so a step that
+	// reads the output right after the build sees it durably on disk.
+	// Only meaningful with output-type=dir.
+	syncKey = "sync"
+
+	// brokenSymlinksKey selects what happens when the export contains a
+	// symlink whose target cannot be resolved within the exported tree:
+	// "keep" (default) exports it untouched, "warn" logs each dangling
+	// link, "error" fails the export on the first one. Catches build bugs
+	// before they surface at extraction time on the client.
+	brokenSymlinksKey = "broken-symlinks"
+
+	brokenSymlinksKeep  = "keep"
+	brokenSymlinksWarn  = "warn"
+	brokenSymlinksError = "error"
+
+	// whiteoutsKey selects how layer whiteout files are serialized:
+	// "keep" (default) passes them through verbatim, which can confuse
+	// consumers that don't expect .wh. markers or 0:0 char devices;
+	// "strip" drops them from the export; "convert" rewrites overlayfs
+	// whiteouts (0:0 char devices, opaque dir xattrs) into the OCI .wh.
+	// naming convention.
+	whiteoutsKey = "whiteouts"
+
+	whiteoutsKeep    = "keep"
+	whiteoutsStrip   = "strip"
+	whiteoutsConvert = "convert"
+
+	// specialFilesKey selects how character/block devices, FIFOs and
+	// sockets are serialized: "keep" (default) writes them as their
+	// native tar entry types, "skip" drops them from the export, "error"
+	// fails the export naming the first offending path. Extracting
+	// device nodes requires privileges, so exports destined for
+	// unprivileged extraction typically want "skip". Sockets cannot be
+	// represented in tar and are dropped even with "keep".
+	specialFilesKey = "special-files"
+
+	specialFilesKeep  = "keep"
+	specialFilesSkip  = "skip"
+	specialFilesError = "error"
+
+	// checksumsKey enables a per-file digest manifest: every regular
+	// file is digested while it is written and a SHA256SUMS entry in the
+	// sha256sum(1) line format is appended at the root of the tree, or
+	// of each platform subtree for multi-platform exports. The manifest
+	// is written last and does not list itself. "sha256" is currently
+	// the only supported algorithm.
+	checksumsKey = "checksums"
+
+	checksumsSHA256 = "sha256"
+
+	// stripSpecialBitsKey is an exporter option that clears setuid, setgid
+	// and sticky bits from all exported entries, for pipelines that untar
+	// as root. Reported in the export metadata when active.
+	stripSpecialBitsKey = "strip-special-bits"
+
+	exporterSpecialBitsStrippedKey = "tarball.special-bits-stripped"
+
+	// uidMapKey and gidMapKey remap entry ownership using comma-separated
+	// container:host:size triples (runc idmap grammar). mapStrictKey makes
+	// ids not covered by any range an error instead of passing through.
+	uidMapKey    = "uid-map"
+	gidMapKey    = "gid-map"
+	mapStrictKey = "map-strict"
+
+	// pathPrefixKey is an exporter option that nests all exported entries
+	// under the given directory prefix, e.g. "rootfs" or "out/rootfs".
+	pathPrefixKey = "path-prefix"
+
+	// computeDigestKey is an exporter option that computes a streaming
+	// SHA256 of the tarball as it is sent and returns it together with the
+	// byte size in the export metadata.
+	computeDigestKey = "compute-digest"
+
+	exporterDigestKey = "tarball.digest"
+
+	// exporterOptionsKey echoes the options the export ran with, as a
+	// JSON object, so consumers can record exactly how an artifact was
+	// produced. Credentials in output-url and output-header-* values are
+	// redacted.
+	exporterOptionsKey = "export.options"
+	exporterSizeKey    = "tarball.size"
+
+	// exporterPlatformSizesKey reports the uncompressed tar bytes written
+	// for each platform subtree (JSON object keyed by platform ID) when
+	// using the streaming per-platform write path.
+	exporterPlatformSizesKey = "platform.sizes"
+
+	// formatKey is an exporter option selecting what the export contains:
+	// "rootfs" (default) sends the plain filesystem of the result, while
+	// "oci" assembles an OCI image layout (oci-layout, index.json,
+	// blobs/sha256/...) of the same result, giving a self-contained
+	// registry-free artifact. In layout mode each platform becomes a
+	// single-layer manifest and the index carries the platform entries.
+	formatKey = "format"
+
+	formatRootfs = "rootfs"
+	formatOCI    = "oci"
+
+	// formatsKey requests several output formats from one export, as a
+	// comma-separated list of format values (e.g. "rootfs,oci"). Each
+	// format is produced from the same solve and sent over its own file
+	// writer, with per-format digests reported under format.digests.
+	formatsKey = "formats"
+
+	// exporterFormatDigestsKey maps each format produced via formatsKey
+	// to the digest of its artifact, as a JSON object.
+	exporterFormatDigestsKey = "format.digests"
+
+	// annotationKeyPrefix and annotationIndexKeyPrefix prefix exporter
+	// options injecting arbitrary OCI annotations in format=oci mode:
+	// annotation.<key>=<value> is applied to every layer descriptor and
+	// annotation-index.<key>=<value> to the index, e.g. for supply-chain
+	// metadata like org.opencontainers.image.source. Keys must be
+	// non-empty and values valid UTF-8.
+	annotationKeyPrefix      = "annotation."
+	annotationIndexKeyPrefix = "annotation-index."
+
+	// platformNestedKey is an exporter option that keeps slash-separated
+	// platform keys as a real nested directory layout (linux/amd64/...)
+	// instead of flattening them to a single sanitized name
+	// (linux_amd64/...). The synthetic intermediate directories honor the
+	// export epoch. Mutually exclusive with platform-separator and
+	// platform-template, which control the flattened name.
+	platformNestedKey = "platform-nested"
+
+	// dryRunKey is an exporter option that performs all export planning —
+	// platform resolution, filesystem assembly, filters, prefixes — but
+	// transfers nothing. Export instead returns metadata describing the
+	// would-be output (see the dryrun.* keys), letting users validate a
+	// complex configuration without moving data.
+	dryRunKey = "dry-run"
+
+	// dryrun.* metadata keys report the planned output of a dry-run
+	// export: the exported platform IDs as a JSON array, the number of
+	// filesystem entries, and the total regular-file bytes.
+	exporterDryRunKey          = "dryrun"
+	exporterDryRunPlatformsKey = "dryrun.platforms"
+	exporterDryRunEntriesKey   = "dryrun.entries"
+	exporterDryRunSizeKey      = "dryrun.size"
+
+	// allowEmptyKey is an exporter option controlling what happens when the
+	// build produced no output (nil ref and no refs map). By default the
+	// export fails with a clear error instead of silently sending a
+	// zero-byte tarball; with allow-empty=true a valid empty tar is
+	// produced.
+	allowEmptyKey = "allow-empty"
+
+	// outputURLKey is an exporter option that uploads the tarball with an
+	// HTTP PUT to the given http(s) URL instead of streaming it over the
+	// client session, for headless pipelines pushing straight to object
+	// storage. Credentials in the URL userinfo are sent as basic auth.
+	// Additional request headers can be set with output-header-<Name>
+	// options. Non-2xx responses fail the export.
+	outputURLKey = "output-url"
+
+	// outputHeaderKeyPrefix prefixes options setting extra HTTP request
+	// headers for output-url uploads, e.g.
+	// "output-header-Content-Type=application/gzip".
+	outputHeaderKeyPrefix = "output-header-"
+
+	// sessionTimeoutKey is an exporter option overriding how long Export
+	// waits to acquire the client session (duration string, default 5s).
+	sessionTimeoutKey = "session-timeout"
+
+	// sessionRetriesKey is an exporter option overriding how many times
+	// Export attempts to acquire the client session (default 3). A client
+	// that just reconnected can transiently fail the first attempt, so
+	// attempts after the first are spaced with exponential backoff.
+	sessionRetriesKey = "session-retries"
+
+	// progressRateKey is an exporter option capping how many progress
+	// updates per second are emitted while transferring (default 10). The
+	// final update is always delivered regardless of the rate.
+	progressRateKey = "progress-rate"
+
+	// progressNameKey overrides the name reported for this export in the
+	// progress stream, both as the exporter name and as the one-off
+	// sending status. Useful for embedders running several exports in
+	// parallel, where the default fixed strings collide in the UI.
+	progressNameKey = "progress-name"
+
+	// perPlatformProgressKey additionally reports a child transfer status
+	// per platform, so multi-platform exports show each architecture's
+	// progress separately instead of one combined counter. Only the
+	// streaming write path serializes one platform at a time and can
+	// attribute bytes, so this requires the stream option.
+	perPlatformProgressKey = "per-platform-progress"
+
+	defaultSessionTimeout = 5 * time.Second
+	defaultSessionRetries = 3
+
+	// platformEpochKeyPrefix prefixes per-platform epoch overrides, e.g.
+	// "epoch.linux/arm64=1672531200". A per-platform value takes precedence
+	// over the global source-date-epoch for that platform's subtree.
+	platformEpochKeyPrefix = "epoch."
+
+	// formatEpochKeyPrefix prefixes per-format epoch overrides, e.g.
+	// "format-epoch.oci=0" pins the OCI layout timestamps while the
+	// rootfs keeps its file mtimes. The rootfs content uses the most
+	// specific epoch available: epoch.<platform>, then
+	// format-epoch.rootfs, then the global source-date-epoch. The OCI
+	// layout metadata (created fields, layout file mtimes) uses
+	// format-epoch.oci, falling back to the global epoch.
+	formatEpochKeyPrefix = "format-epoch."
+
+	// attestationsOutputKey selects how attestations are delivered:
+	// "inline" (default) bundles them into the main tarball, "separate"
+	// sends them as a second tar stream after the rootfs and omits them
+	// from the main one. Reported in the export metadata when separate.
+	attestationsOutputKey = "attestations-output"
+
+	attestationsOutputInline   = "inline"
+	attestationsOutputSeparate = "separate"
+
+	exporterAttestationsKey = "tarball.attestations"
+
+	// skipAttestationsKey is an exporter option that leaves SBOM/provenance
+	// files out of the export entirely. This only affects what is sent to
+	// the client, not the solve result itself.
+	skipAttestationsKey = "skip-attestations"
+
+	// attestationsOnlyKey is an exporter option that exports just the
+	// attestation documents (SBOM, provenance), skipping the rootfs
+	// entirely, for supply-chain pipelines that store attestations apart
+	// from the artifact. Subject digests are still computed from the
+	// built rootfs, so the documents match the regular export. Fails when
+	// the build produced no attestations.
+	attestationsOnlyKey = "attestations-only"
+
+	// provenanceInlineKey additionally writes the SLSA provenance
+	// predicate as a well-known provenance.json at the root of the tree
+	// (or of each platform subtree), next to whatever the attestation
+	// prefix produces, for tools that want the bare predicate without
+	// parsing in-toto envelopes. Its mtime follows the export epoch.
+	provenanceInlineKey = "provenance-inline"
+
+	// clampMtimeKey is an exporter option that only rewrites file mtimes
+	// that are later than the configured epoch instead of overwriting all
+	// of them, matching SOURCE_DATE_EPOCH clamping semantics.
+	clampMtimeKey = "clamp-mtime"
+
+	// streamKey is an exporter option that writes multi-platform exports
+	// one platform at a time, releasing each platform's mounts before the
+	// next is created, instead of assembling the whole filesystem up front.
+	streamKey = "stream"
+
+	// tarBlockingFactorKey pads the end of the tar stream to a multiple
+	// of the given record size in bytes (e.g. 10240 for the classic
+	// 20-block tape record), for legacy tape-oriented or streaming
+	// consumers that require fixed blocking. Must be a positive multiple
+	// of 512. The default pads to single 512-byte blocks only.
+	tarBlockingFactorKey = "tar-blocking-factor"
+
+	// alignKey pads the final tar stream with zero bytes to the next
+	// multiple of the given size (e.g. 4k for firmware packaging that
+	// requires aligned images). The alignment must be a power of two or a
+	// multiple of 512. Standard extractors ignore the trailing zeros.
+	alignKey = "align"
+
+	// defaultUnameKey and defaultGnameKey set the textual owner names in
+	// tar headers when the source filesystem provides none, for consumers
+	// that key off Uname/Gname rather than the numeric ids. unameMapKey
+	// and gnameMapKey additionally map specific ids to names, as
+	// comma-separated id=name pairs (e.g. "0=root,1000=builder"), taking
+	// precedence over the defaults. Names are carried in pax or gnu
+	// headers; tar-format=ustar is rejected.
+	defaultUnameKey = "default-uname"
+	defaultGnameKey = "default-gname"
+	unameMapKey     = "uname-map"
+	gnameMapKey     = "gname-map"
+
+	// verifyKey enables an opt-in verification pass: the produced tar
+	// stream is teed into a parser that re-reads every header and checks
+	// that the archive terminates cleanly, failing the export instead of
+	// delivering a corrupted artifact. Costs CPU proportional to the
+	// export size; off by default. The number of verified entries is
+	// reported in the completion summary.
+	verifyKey = "verify"
+
+	// maxFileSizeKey aborts the export if any single file exceeds the
+	// given size (accepts unit suffixes, e.g. 512m), naming the offending
+	// path. maxTotalSizeKey caps the size of the whole export. Both are
+	// safety valves for shared environments and default to unlimited.
+	maxFileSizeKey  = "max-file-size"
+	maxTotalSizeKey = "max-total-size"
+
+	// expectFilesKey fails the export when the number of regular-file
+	// entries written differs from the given count, catching builds that
+	// silently drop files. Synthetic entries like the checksum manifest
+	// are not counted; hardlink and symlink entries are not regular
+	// files.
+	expectFilesKey = "expect-files"
+
+	// defaultPlatformKey selects which platform ends up in a flat
+	// (non-map) export when the result carries several, instead of
+	// implicitly taking the first entry of the platforms list. The value
+	// matches a platform id or a platform spec (e.g. linux/amd64); a
+	// value matching none of the available platforms is an error.
+	defaultPlatformKey = "default-platform"
+
+	// hostPlatformLinkKey names an extra entry added at the root of
+	// multi-platform exports: a symlink (e.g. "current") pointing at the
+	// subdirectory of the platform matching the client's host platform,
+	// as reported in the session metadata. Extract scripts can then use
+	// one stable path regardless of the architecture they run on. When
+	// the client does not report a platform, or none of the exported
+	// platforms match it, the link is omitted unless
+	// require-host-platform makes that an error.
+	hostPlatformLinkKey    = "host-platform-link"
+	requireHostPlatformKey = "require-host-platform"
+
+	// diffBaseKey names the ref id of a base to diff against: only
+	// entries that differ from the base are exported, with OCI-style
+	// .wh. whiteout entries for deletions, producing a much smaller
+	// update tarball. Consumers must apply it over the base to
+	// reconstruct the full tree. The comparison is stat-based; content
+	// changes that alter neither size nor mtime are not detected. Only
+	// single-platform exports are supported.
+	diffBaseKey = "diff-base"
+
+	// writeMetadataKey names a path inside the export at which a JSON
+	// document describing the export (platforms, resolved options, epoch)
+	// is written. This makes the extracted tree self-describing, which is
+	// the only metadata channel with output-type=dir. Parent directories
+	// of the path are created as needed.
+	writeMetadataKey = "write-metadata"
+
+	// fanoutSessionsKey is an exporter option with a comma-separated list
+	// of additional session IDs to send the tarball to. The identical
+	// (compressed) stream is duplicated to every listed session, so one
+	// solve can serve several connected clients in broadcast scenarios.
+	// Each extra consumer drains its own bounded buffer; see
+	// fanout-policy for what happens when one cannot keep up.
+	fanoutSessionsKey = "fanout-sessions"
+
+	// fanoutPolicyKey selects how a failing or too-slow fan-out consumer
+	// is handled: "error" (default) fails the export, "drop" disconnects
+	// that consumer and continues for the rest. An error on the primary
+	// session always fails the export regardless of the policy.
+	fanoutPolicyKey = "fanout-policy"
+
+	fanoutPolicyError = "error"
+	fanoutPolicyDrop  = "drop"
+
+	// suggestFilenameKey is an exporter option returning a suggested
+	// download name for the tarball in the export metadata, built from
+	// the epoch date and the exported platform set, e.g.
+	// "build-2024-01-01-linux_amd64.tar". The name is advisory only;
+	// clients may use it as a default filename. With a pinned epoch the
+	// date component is stable, so reproducible builds keep a stable
+	// suggested name.
+	suggestFilenameKey = "suggest-filename"
+
+	exporterSuggestedNameKey = "tarball.suggested-name"
+
+	// writeBufferSizeKey is an exporter option buffering writes to the
+	// client stream with the given size (e.g. "1m"). Each write to the
+	// session costs a round trip, so for high-latency connections a
+	// larger buffer reduces the per-write overhead. The buffer is flushed
+	// before the stream closes. Must be between 4KiB and 64MiB; unset
+	// leaves writes unbuffered.
+	writeBufferSizeKey = "write-buffer-size"
+
+	// strictOptionsKey makes Resolve fail on unrecognized option keys
+	// instead of silently ignoring them, so typos like "comprssion=gzip"
+	// surface immediately rather than producing default behavior. Keys
+	// consumed by the epoch and multi-platform attr parsers count as
+	// recognized.
+	strictOptionsKey = "strict-options"
 )
 
-type Opt struct {
-	SessionManager *session.Manager
+type Opt struct {
+	SessionManager *session.Manager
+	// HeaderMutator, when set, is invoked for every tar entry before it
+	// is written, after all option-driven header transformations. It is a
+	// library-level extension point for embedders that need programmatic
+	// control over mode, ownership, mtime or name, beyond what the
+	// string-based options (chmod, uid-map, ...) express. Mutations must
+	// keep entry names within the exported tree: absolute names or names
+	// escaping via ".." fail the export. Nil disables the hook.
+	HeaderMutator HeaderMutator
+}
+
+// HeaderMutator adjusts a tar header in place before the entry is
+// written. Returning an error aborts the export.
+type HeaderMutator func(hdr *tar.Header) error
+
+type localExporter struct {
+	opt Opt
+	// now is the exporter's clock, indirected so tests can pin it and
+	// exercise the timestamp handling deterministically
+	now func() time.Time
+}
+
+func New(opt Opt) (exporter.Exporter, error) {
+	le := &localExporter{opt: opt, now: time.Now}
+	return le, nil
+}
+
+func (e *localExporter) Resolve(ctx context.Context, opt map[string]string) (exporter.ExporterInstance, error) {
+	li := &localExporterInstance{localExporter: e, headerMutator: e.opt.HeaderMutator}
+
+	tm, opt, err := epoch.ParseExporterAttrs(opt)
+	if err != nil {
+		return nil, err
+	}
+	li.opts.Epoch = tm
+
+	multiPlatform, opt, err := multiplatform.ParseExporterAttrs(opt)
+	if err != nil {
+		return nil, err
+	}
+	li.opts.MultiPlatform = multiPlatform
+
+	var strictOptions bool
+	var unknownOpts []string
+	for k, v := range opt {
+		switch k {
+		case strictOptionsKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", strictOptionsKey, v)
+			}
+			strictOptions = b
+		case preferNondistLayersKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", preferNondistLayersKey, v)
+			}
+			li.preferNonDist = b
+		case attestationPrefixKey:
+			if strings.Contains(v, attestationPlatformPlaceholder) {
+				// expansion happens per platform at export time; check
+				// everything but the token now
+				if _, err := local.ValidateAttestationPrefix(strings.ReplaceAll(v, attestationPlatformPlaceholder, "platform")); err != nil {
+					return nil, err
+				}
+				li.opts.AttestationPrefix = v
+				continue
+			}
+			prefix, err := local.ValidateAttestationPrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			li.opts.AttestationPrefix = prefix
+		case compressionKey:
+			switch v {
+			case "", "gzip", "zstd", "lz4":
+				if li.compression != "" && li.compression != v {
+					return nil, errors.Errorf("conflicting values for %s: %s and %s", compressionKey, li.compression, v)
+				}
+				li.compression = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", compressionKey, v)
+			}
+		case compressionLevelKey:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value for %s: %s", compressionLevelKey, v)
+			}
+			li.compressionLevel = &n
+		case compressionThreadsKey:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value for %s: %s", compressionThreadsKey, v)
+			}
+			if n <= 0 {
+				return nil, errors.Errorf("%s must be positive: %s", compressionThreadsKey, v)
+			}
+			if max := runtime.NumCPU(); n > max {
+				n = max
+			}
+			li.compressionThreads = n
+		case zstdDictKey:
+			if v == "" {
+				return nil, errors.Errorf("%s requires a URL value", zstdDictKey)
+			}
+			if _, err := url.Parse(v); err != nil {
+				return nil, errors.Wrapf(err, "invalid URL for %s: %s", zstdDictKey, v)
+			}
+			li.zstdDictURL = v
+		case deterministicKey:
+			if v == deterministicStrict {
+				li.deterministic = true
+				li.strictDeterministic = true
+				continue
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", deterministicKey, v)
+			}
+			li.deterministic = b
+		case outputTypeKey:
+			switch v {
+			case "", outputTypeTar, outputTypeDir:
+				li.outputType = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", outputTypeKey, v)
+			}
+		case splitSizeKey:
+			n, err := units.RAMInBytes(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", splitSizeKey, v)
+			}
+			if n <= 0 {
+				return nil, errors.Errorf("%s must be positive: %s", splitSizeKey, v)
+			}
+			li.splitSize = n
+		case tarBlockingFactorKey:
+			n, err := units.RAMInBytes(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", tarBlockingFactorKey, v)
+			}
+			if n <= 0 || n%512 != 0 {
+				return nil, errors.Errorf("%s must be a positive multiple of 512: %s", tarBlockingFactorKey, v)
+			}
+			li.recordSize = n
+		case alignKey:
+			n, err := units.RAMInBytes(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", alignKey, v)
+			}
+			if n <= 0 || (n&(n-1) != 0 && n%512 != 0) {
+				return nil, errors.Errorf("%s must be a power of two or a multiple of 512: %s", alignKey, v)
+			}
+			li.align = n
+		case defaultUnameKey:
+			if v == "" {
+				return nil, errors.Errorf("empty value for %s", defaultUnameKey)
+			}
+			li.defaultUname = v
+		case defaultGnameKey:
+			if v == "" {
+				return nil, errors.Errorf("empty value for %s", defaultGnameKey)
+			}
+			li.defaultGname = v
+		case unameMapKey:
+			m, err := parseNameMap(unameMapKey, v)
+			if err != nil {
+				return nil, err
+			}
+			li.unameMap = m
+		case gnameMapKey:
+			m, err := parseNameMap(gnameMapKey, v)
+			if err != nil {
+				return nil, err
+			}
+			li.gnameMap = m
+		case verifyKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", verifyKey, v)
+			}
+			li.verify = b
+		case maxFileSizeKey:
+			n, err := units.RAMInBytes(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", maxFileSizeKey, v)
+			}
+			if n <= 0 {
+				return nil, errors.Errorf("%s must be positive: %s", maxFileSizeKey, v)
+			}
+			li.maxFileSize = n
+		case maxTotalSizeKey:
+			n, err := units.RAMInBytes(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", maxTotalSizeKey, v)
+			}
+			if n <= 0 {
+				return nil, errors.Errorf("%s must be positive: %s", maxTotalSizeKey, v)
+			}
+			li.maxTotalSize = n
+		case expectFilesKey:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value for %s: %s", expectFilesKey, v)
+			}
+			if n < 0 {
+				return nil, errors.Errorf("%s cannot be negative: %s", expectFilesKey, v)
+			}
+			li.expectFiles = &n
+		case tarFormatKey:
+			switch v {
+			case "", "pax":
+				li.tarFormat = tar.FormatPAX
+			case "gnu":
+				li.tarFormat = tar.FormatGNU
+			case "ustar":
+				li.tarFormat = tar.FormatUSTAR
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", tarFormatKey, v)
+			}
+		case indexKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", indexKey, v)
+			}
+			li.index = b
+		case bomKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", bomKey, v)
+			}
+			li.bom = b
+		case rootModeKey:
+			mode, err := strconv.ParseInt(v, 8, 32)
+			if err != nil || mode < 0 || mode > 07777 {
+				return nil, errors.Errorf("invalid octal mode for %s: %s", rootModeKey, v)
+			}
+			m := os.FileMode(mode)
+			li.rootMode = &m
+		case rootUidKey:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value for %s: %s", rootUidKey, v)
+			}
+			if n < 0 {
+				return nil, errors.Errorf("%s cannot be negative: %s", rootUidKey, v)
+			}
+			li.rootUID = n
+		case rootGidKey:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value for %s: %s", rootGidKey, v)
+			}
+			if n < 0 {
+				return nil, errors.Errorf("%s cannot be negative: %s", rootGidKey, v)
+			}
+			li.rootGID = n
+		case platformSeparatorKey:
+			switch v {
+			case "", "_", "-", ".":
+				li.platformSeparator = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %q (must be one of \"_\", \"-\", \".\")", platformSeparatorKey, v)
+			}
+		case platformsKey:
+			for _, spec := range strings.Split(v, ",") {
+				spec = strings.TrimSpace(spec)
+				if spec == "" {
+					continue
+				}
+				if _, err := platforms.Parse(spec); err != nil {
+					return nil, errors.Wrapf(err, "invalid platform in %s: %s", platformsKey, spec)
+				}
+				li.platformFilter = append(li.platformFilter, spec)
+			}
+			if len(li.platformFilter) == 0 {
+				return nil, errors.Errorf("empty value for %s", platformsKey)
+			}
+		case singlePlatformFlattenKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", singlePlatformFlattenKey, v)
+			}
+			li.singlePlatformFlatten = b
+		case platformTemplateKey:
+			if err := validatePlatformTemplate(v); err != nil {
+				return nil, err
+			}
+			li.platformTemplate = v
+		case includeKey:
+			li.opts.IncludePatterns = parsePatterns(v)
+		case excludeKey:
+			li.opts.ExcludePatterns = parsePatterns(v)
+		case preserveXattrsKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", preserveXattrsKey, v)
+			}
+			li.preserveXattrs = b
+		case preserveCapsKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", preserveCapsKey, v)
+			}
+			li.preserveCaps = b
+		case capsStrictKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", capsStrictKey, v)
+			}
+			li.capsStrict = b
+		case stripSpecialBitsKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", stripSpecialBitsKey, v)
+			}
+			li.stripSpecialBits = b
+		case formatKey:
+			switch v {
+			case formatRootfs:
+				li.ociLayout = false
+			case formatOCI:
+				li.ociLayout = true
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", formatKey, v)
+			}
+			li.formatSet = true
+		case formatsKey:
+			seen := map[string]struct{}{}
+			for _, f := range strings.Split(v, ",") {
+				f = strings.TrimSpace(f)
+				switch f {
+				case formatRootfs, formatOCI:
+				default:
+					return nil, errors.Errorf("unsupported value for %s: %s", formatsKey, f)
+				}
+				if _, ok := seen[f]; ok {
+					return nil, errors.Errorf("duplicate format %s in %s", f, formatsKey)
+				}
+				seen[f] = struct{}{}
+				li.outputFormats = append(li.outputFormats, f)
+			}
+			if len(li.outputFormats) == 0 {
+				return nil, errors.Errorf("empty value for %s", formatsKey)
+			}
+		case platformNestedKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", platformNestedKey, v)
+			}
+			li.platformNested = b
+		case dryRunKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", dryRunKey, v)
+			}
+			li.dryRun = b
+		case allowEmptyKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", allowEmptyKey, v)
+			}
+			li.allowEmpty = b
+		case pruneEmptyDirsKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", pruneEmptyDirsKey, v)
+			}
+			li.pruneEmptyDirs = b
+		case keepEmptyDirsKey:
+			li.keepEmptyDirs = parsePatterns(v)
+		case casefoldKey:
+			switch v {
+			case casefoldLower, casefoldDetect:
+				li.caseFold = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", casefoldKey, v)
+			}
+		case textEOLKey:
+			switch v {
+			case textEOLLF, textEOLCRLF:
+				li.textEOL = v
+			case textEOLNone:
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", textEOLKey, v)
+			}
+		case textEOLGlobsKey:
+			m, err := patternmatcher.New(parsePatterns(v))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid pattern for %s: %s", textEOLGlobsKey, v)
+			}
+			li.textEOLMatcher = m
+		case sparseKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", sparseKey, v)
+			}
+			li.sparse = b
+		case dedupHardlinksKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", dedupHardlinksKey, v)
+			}
+			li.dedupHardlinks = b
+		case chmodKey:
+			rules, err := parseChmodRules(v)
+			if err != nil {
+				return nil, err
+			}
+			li.chmodRules = rules
+		case dedupContentKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", dedupContentKey, v)
+			}
+			li.dedupContent = b
+		case symlinksKey:
+			switch v {
+			case symlinksPreserve, symlinksFollow, symlinksError:
+				li.symlinkMode = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", symlinksKey, v)
+			}
+		case syncKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", syncKey, v)
+			}
+			li.syncDir = b
+		case brokenSymlinksKey:
+			switch v {
+			case brokenSymlinksKeep, brokenSymlinksWarn, brokenSymlinksError:
+				li.brokenSymlinks = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", brokenSymlinksKey, v)
+			}
+		case whiteoutsKey:
+			switch v {
+			case whiteoutsKeep, whiteoutsStrip, whiteoutsConvert:
+				li.whiteoutMode = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", whiteoutsKey, v)
+			}
+		case specialFilesKey:
+			switch v {
+			case specialFilesKeep, specialFilesSkip, specialFilesError:
+				li.specialFiles = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", specialFilesKey, v)
+			}
+		case checksumsKey:
+			switch v {
+			case checksumsSHA256:
+				li.checksums = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", checksumsKey, v)
+			}
+		case uidMapKey:
+			m, err := parseIDMap(k, v)
+			if err != nil {
+				return nil, err
+			}
+			li.uidMap = m
+		case gidMapKey:
+			m, err := parseIDMap(k, v)
+			if err != nil {
+				return nil, err
+			}
+			li.gidMap = m
+		case mapStrictKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", mapStrictKey, v)
+			}
+			li.mapStrict = b
+		case defaultPlatformKey:
+			if v == "" {
+				return nil, errors.Errorf("empty value for %s", defaultPlatformKey)
+			}
+			li.defaultPlatform = v
+		case hostPlatformLinkKey:
+			name := strings.Trim(v, "/")
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+				return nil, errors.Errorf("invalid value for %s: %q", hostPlatformLinkKey, v)
+			}
+			li.hostPlatformLink = name
+		case requireHostPlatformKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", requireHostPlatformKey, v)
+			}
+			li.requireHostPlatform = b
+		case diffBaseKey:
+			if v == "" {
+				return nil, errors.Errorf("empty value for %s", diffBaseKey)
+			}
+			li.diffBase = v
+		case writeMetadataKey:
+			mdPath := strings.Trim(v, "/")
+			if mdPath == "" {
+				return nil, errors.Errorf("empty value for %s", writeMetadataKey)
+			}
+			for _, seg := range strings.Split(mdPath, "/") {
+				if seg == "" || seg == "." || seg == ".." {
+					return nil, errors.Errorf("invalid value for %s: %q", writeMetadataKey, v)
+				}
+			}
+			li.writeMetadataPath = mdPath
+		case pathPrefixKey:
+			prefix := strings.Trim(v, "/")
+			if prefix == "" {
+				return nil, errors.Errorf("empty value for %s", pathPrefixKey)
+			}
+			for _, seg := range strings.Split(prefix, "/") {
+				if seg == "" || seg == "." || seg == ".." {
+					return nil, errors.Errorf("invalid value for %s: %q", pathPrefixKey, v)
+				}
+			}
+			li.pathPrefix = prefix
+		case computeDigestKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", computeDigestKey, v)
+			}
+			li.computeDigest = b
+		case sessionTimeoutKey:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", sessionTimeoutKey, v)
+			}
+			if d <= 0 {
+				return nil, errors.Errorf("%s must be positive: %s", sessionTimeoutKey, v)
+			}
+			li.sessionTimeout = d
+		case sessionRetriesKey:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value for %s: %s", sessionRetriesKey, v)
+			}
+			if n <= 0 {
+				return nil, errors.Errorf("%s must be positive: %s", sessionRetriesKey, v)
+			}
+			li.sessionRetries = n
+		case progressNameKey:
+			if v == "" {
+				return nil, errors.Errorf("empty value for %s", progressNameKey)
+			}
+			li.progressName = v
+		case progressRateKey:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-int value for %s: %s", progressRateKey, v)
+			}
+			if n <= 0 {
+				return nil, errors.Errorf("%s must be positive: %s", progressRateKey, v)
+			}
+			li.progressInterval = time.Second / time.Duration(n)
+		case perPlatformProgressKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", perPlatformProgressKey, v)
+			}
+			li.perPlatformProgress = b
+		case streamKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", streamKey, v)
+			}
+			li.stream = b
+		case writeBufferSizeKey:
+			n, err := units.RAMInBytes(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", writeBufferSizeKey, v)
+			}
+			if n < 4*1024 || n > 64*1024*1024 {
+				return nil, errors.Errorf("%s must be between 4KiB and 64MiB: %s", writeBufferSizeKey, v)
+			}
+			li.writeBufferSize = int(n)
+		case suggestFilenameKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", suggestFilenameKey, v)
+			}
+			li.suggestFilename = b
+		case fanoutSessionsKey:
+			for _, id := range strings.Split(v, ",") {
+				id = strings.TrimSpace(id)
+				if id == "" {
+					return nil, errors.Errorf("empty session id in %s: %s", fanoutSessionsKey, v)
+				}
+				li.fanoutSessions = append(li.fanoutSessions, id)
+			}
+		case fanoutPolicyKey:
+			switch v {
+			case fanoutPolicyError, fanoutPolicyDrop:
+				li.fanoutPolicy = v
+			default:
+				return nil, errors.Errorf("invalid value for %s: %s (must be %s or %s)", fanoutPolicyKey, v, fanoutPolicyError, fanoutPolicyDrop)
+			}
+		case clampMtimeKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", clampMtimeKey, v)
+			}
+			li.opts.ClampMtime = b
+		case attestationsOutputKey:
+			switch v {
+			case "", attestationsOutputInline, attestationsOutputSeparate:
+				li.attestationsOutput = v
+			default:
+				return nil, errors.Errorf("unsupported value for %s: %s", attestationsOutputKey, v)
+			}
+		case skipAttestationsKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", skipAttestationsKey, v)
+			}
+			li.opts.SkipAttestations = b
+		case attestationsOnlyKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", attestationsOnlyKey, v)
+			}
+			li.attestationsOnly = b
+		case provenanceInlineKey:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "non-bool value for %s: %s", provenanceInlineKey, v)
+			}
+			li.opts.InlineProvenance = b
+		case outputURLKey:
+			u, err := url.Parse(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s: %s", outputURLKey, v)
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return nil, errors.Errorf("%s must be an http(s) URL: %s", outputURLKey, v)
+			}
+			li.outputURL = v
+		default:
+			if strings.HasPrefix(k, annotationIndexKeyPrefix) {
+				name := strings.TrimPrefix(k, annotationIndexKeyPrefix)
+				if err := validateAnnotation(name, v); err != nil {
+					return nil, err
+				}
+				if li.indexAnnotations == nil {
+					li.indexAnnotations = map[string]string{}
+				}
+				li.indexAnnotations[name] = v
+				continue
+			}
+			if strings.HasPrefix(k, annotationKeyPrefix) {
+				name := strings.TrimPrefix(k, annotationKeyPrefix)
+				if err := validateAnnotation(name, v); err != nil {
+					return nil, err
+				}
+				if li.annotations == nil {
+					li.annotations = map[string]string{}
+				}
+				li.annotations[name] = v
+				continue
+			}
+			if strings.HasPrefix(k, outputHeaderKeyPrefix) {
+				if li.outputHeaders == nil {
+					li.outputHeaders = map[string]string{}
+				}
+				li.outputHeaders[strings.TrimPrefix(k, outputHeaderKeyPrefix)] = v
+				continue
+			}
+			if strings.HasPrefix(k, formatEpochKeyPrefix) {
+				f := strings.TrimPrefix(k, formatEpochKeyPrefix)
+				switch f {
+				case formatRootfs, formatOCI:
+				default:
+					return nil, errors.Errorf("unknown format %q in %s", f, k)
+				}
+				tm, err := epoch.ParseTime(k, v)
+				if err != nil {
+					return nil, err
+				}
+				if li.formatEpochs == nil {
+					li.formatEpochs = map[string]*time.Time{}
+				}
+				li.formatEpochs[f] = tm
+				continue
+			}
+			if strings.HasPrefix(k, platformEpochKeyPrefix) {
+				platform := strings.TrimPrefix(k, platformEpochKeyPrefix)
+				tm, err := epoch.ParseTime(k, v)
+				if err != nil {
+					return nil, err
+				}
+				if li.platformEpochs == nil {
+					li.platformEpochs = map[string]*time.Time{}
+				}
+				li.platformEpochs[platform] = tm
+				continue
+			}
+			unknownOpts = append(unknownOpts, k)
+		}
+	}
+
+	if len(unknownOpts) > 0 {
+		// sorted so the diagnostic is stable across map iteration order
+		sort.Strings(unknownOpts)
+		if strictOptions {
+			return nil, errors.Errorf("unknown exporter options: %s", strings.Join(unknownOpts, ", "))
+		}
+		bklog.G(ctx).Warnf("ignoring unknown exporter options: %s", strings.Join(unknownOpts, ", "))
+	}
+
+	if li.opts.InlineProvenance {
+		if li.opts.SkipAttestations {
+			return nil, errors.Errorf("%s cannot be combined with %s", provenanceInlineKey, skipAttestationsKey)
+		}
+		if li.attestationsOutput == attestationsOutputSeparate {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", provenanceInlineKey, attestationsOutputKey, attestationsOutputSeparate)
+		}
+	}
+
+	if li.attestationsOutput == attestationsOutputSeparate {
+		if li.opts.SkipAttestations {
+			return nil, errors.Errorf("%s=%s cannot be combined with %s", attestationsOutputKey, attestationsOutputSeparate, skipAttestationsKey)
+		}
+		if li.splitSize > 0 {
+			return nil, errors.Errorf("%s=%s cannot be combined with %s", attestationsOutputKey, attestationsOutputSeparate, splitSizeKey)
+		}
+		if li.stream {
+			return nil, errors.Errorf("%s=%s cannot be combined with %s", attestationsOutputKey, attestationsOutputSeparate, streamKey)
+		}
+		if li.outputType == outputTypeDir {
+			return nil, errors.Errorf("%s=%s cannot be combined with %s=%s", attestationsOutputKey, attestationsOutputSeparate, outputTypeKey, outputTypeDir)
+		}
+	}
+
+	if li.attestationsOnly {
+		if li.opts.SkipAttestations {
+			return nil, errors.Errorf("%s cannot be combined with %s", attestationsOnlyKey, skipAttestationsKey)
+		}
+		if li.attestationsOutput == attestationsOutputSeparate {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", attestationsOnlyKey, attestationsOutputKey, attestationsOutputSeparate)
+		}
+	}
+
+	if li.stream {
+		if li.splitSize > 0 {
+			return nil, errors.Errorf("%s cannot be combined with %s", streamKey, splitSizeKey)
+		}
+		if li.index {
+			return nil, errors.Errorf("%s cannot be combined with %s", streamKey, indexKey)
+		}
+		if li.expectFiles != nil {
+			return nil, errors.Errorf("%s cannot be combined with %s", streamKey, expectFilesKey)
+		}
+		if li.outputType == outputTypeDir {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", streamKey, outputTypeKey, outputTypeDir)
+		}
+	}
+
+	if li.perPlatformProgress && !li.stream {
+		// only the streaming path serializes one platform at a time, so
+		// bytes cannot be attributed to a platform without it
+		return nil, errors.Errorf("%s requires %s to be set", perPlatformProgressKey, streamKey)
+	}
+
+	if li.outputURL != "" {
+		if li.outputType == outputTypeDir {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", outputURLKey, outputTypeKey, outputTypeDir)
+		}
+		if li.splitSize > 0 {
+			return nil, errors.Errorf("%s cannot be combined with %s", outputURLKey, splitSizeKey)
+		}
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", outputURLKey, streamKey)
+		}
+		if li.attestationsOutput == attestationsOutputSeparate {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", outputURLKey, attestationsOutputKey, attestationsOutputSeparate)
+		}
+	}
+	if len(li.outputHeaders) > 0 && li.outputURL == "" {
+		return nil, errors.Errorf("%s options require %s to be set", outputHeaderKeyPrefix, outputURLKey)
+	}
+
+	if (len(li.annotations) > 0 || len(li.indexAnnotations) > 0) && !li.ociLayout && !li.wantsFormat(formatOCI) {
+		return nil, errors.Errorf("annotations require %s=%s", formatKey, formatOCI)
+	}
+
+	if len(li.outputFormats) > 0 {
+		if li.formatSet {
+			return nil, errors.Errorf("%s cannot be combined with %s", formatsKey, formatKey)
+		}
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", formatsKey, streamKey)
+		}
+		if li.splitSize > 0 {
+			return nil, errors.Errorf("%s cannot be combined with %s", formatsKey, splitSizeKey)
+		}
+		if li.outputType == outputTypeDir {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", formatsKey, outputTypeKey, outputTypeDir)
+		}
+		if li.outputURL != "" {
+			return nil, errors.Errorf("%s cannot be combined with %s", formatsKey, outputURLKey)
+		}
+		if li.wantsFormat(formatOCI) {
+			if li.index {
+				return nil, errors.Errorf("%s cannot be combined with %s: the layout has its own index.json", formatsKey, indexKey)
+			}
+			if li.platformNested {
+				return nil, errors.Errorf("%s cannot be combined with %s", formatsKey, platformNestedKey)
+			}
+		}
+	}
+
+	if li.ociLayout {
+		if li.stream {
+			return nil, errors.Errorf("%s=%s cannot be combined with %s", formatKey, formatOCI, streamKey)
+		}
+		if li.index {
+			return nil, errors.Errorf("%s=%s cannot be combined with %s: the layout has its own index.json", formatKey, formatOCI, indexKey)
+		}
+		if li.platformNested {
+			return nil, errors.Errorf("%s=%s cannot be combined with %s", formatKey, formatOCI, platformNestedKey)
+		}
+	}
+
+	if li.bom {
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", bomKey, streamKey)
+		}
+		if li.ociLayout || li.wantsFormat(formatOCI) {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s: the layout carries its own digests", bomKey, formatKey, formatOCI)
+		}
+	}
+
+	if (li.defaultUname != "" || li.defaultGname != "" || len(li.unameMap) > 0 || len(li.gnameMap) > 0) && li.tarFormat == tar.FormatUSTAR {
+		return nil, errors.Errorf("%s requires %s=pax or %s=gnu to store owner names", unameMapKey, tarFormatKey, tarFormatKey)
+	}
+
+	if li.requireHostPlatform && li.hostPlatformLink == "" {
+		return nil, errors.Errorf("%s requires %s to be set", requireHostPlatformKey, hostPlatformLinkKey)
+	}
+	if li.hostPlatformLink != "" {
+		if li.ociLayout {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s: the layout has no platform directories", hostPlatformLinkKey, formatKey, formatOCI)
+		}
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", hostPlatformLinkKey, streamKey)
+		}
+	}
+
+	if li.diffBase != "" {
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", diffBaseKey, streamKey)
+		}
+		if li.whiteoutMode == whiteoutsStrip {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s: the diff records deletions as whiteouts", diffBaseKey, whiteoutsKey, whiteoutsStrip)
+		}
+	}
+
+	if li.verify {
+		if li.splitSize > 0 {
+			return nil, errors.Errorf("%s cannot be combined with %s", verifyKey, splitSizeKey)
+		}
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", verifyKey, streamKey)
+		}
+		if li.outputType == outputTypeDir {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", verifyKey, outputTypeKey, outputTypeDir)
+		}
+	}
+
+	if li.fanoutPolicy != "" && len(li.fanoutSessions) == 0 {
+		return nil, errors.Errorf("%s requires %s to be set", fanoutPolicyKey, fanoutSessionsKey)
+	}
+	if len(li.fanoutSessions) > 0 {
+		if li.outputType == outputTypeDir {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", fanoutSessionsKey, outputTypeKey, outputTypeDir)
+		}
+		if li.splitSize > 0 {
+			return nil, errors.Errorf("%s cannot be combined with %s", fanoutSessionsKey, splitSizeKey)
+		}
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", fanoutSessionsKey, streamKey)
+		}
+		if li.outputURL != "" {
+			return nil, errors.Errorf("%s cannot be combined with %s", fanoutSessionsKey, outputURLKey)
+		}
+		if len(li.outputFormats) > 0 {
+			return nil, errors.Errorf("%s cannot be combined with %s", fanoutSessionsKey, formatsKey)
+		}
+		if li.attestationsOutput == attestationsOutputSeparate {
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", fanoutSessionsKey, attestationsOutputKey, attestationsOutputSeparate)
+		}
+	}
+
+	if len(li.keepEmptyDirs) > 0 && !li.pruneEmptyDirs {
+		return nil, errors.Errorf("%s requires %s to be set", keepEmptyDirsKey, pruneEmptyDirsKey)
+	}
+
+	if li.textEOLMatcher != nil && li.textEOL == "" {
+		return nil, errors.Errorf("%s requires %s to be set", textEOLGlobsKey, textEOLKey)
+	}
+
+	if li.preferNonDist {
+		if li.compression != "" {
+			return nil, errors.Errorf("%s cannot be combined with %s: recompressing would change the preserved non-distributable media types", preferNondistLayersKey, compressionKey)
+		}
+		if li.compressionLevel != nil {
+			return nil, errors.Errorf("%s cannot be combined with %s: recompressing would change the preserved non-distributable media types", preferNondistLayersKey, compressionLevelKey)
+		}
+	}
+
+	if li.platformNested {
+		if li.platformSeparator != "" {
+			return nil, errors.Errorf("%s cannot be combined with %s", platformNestedKey, platformSeparatorKey)
+		}
+		if li.platformTemplate != "" {
+			return nil, errors.Errorf("%s cannot be combined with %s", platformNestedKey, platformTemplateKey)
+		}
+		if li.stream {
+			return nil, errors.Errorf("%s cannot be combined with %s", platformNestedKey, streamKey)
+		}
+	}
+
+	if li.sparse && li.tarFormat != tar.FormatUnknown && li.tarFormat != tar.FormatPAX {
+		return nil, errors.Errorf("%s requires %s=pax: the sparse map is carried in pax extended headers", sparseKey, tarFormatKey)
+	}
+
+	if li.checksums != "" && li.sparse {
+		return nil, errors.Errorf("%s cannot be combined with %s: sparse members bypass the digesting writer", checksumsKey, sparseKey)
+	}
+
+	if li.computeDigest && li.splitSize > 0 {
+		return nil, errors.Errorf("%s cannot be combined with %s", computeDigestKey, splitSizeKey)
+	}
+	if li.computeDigest && li.outputType == outputTypeDir {
+		return nil, errors.Errorf("%s cannot be combined with %s=%s", computeDigestKey, outputTypeKey, outputTypeDir)
+	}
+
+	if li.writeMetadataPath != "" && li.stream {
+		return nil, errors.Errorf("%s cannot be combined with %s", writeMetadataKey, streamKey)
+	}
+
+	if li.mapStrict && len(li.uidMap) == 0 && len(li.gidMap) == 0 {
+		return nil, errors.Errorf("%s requires %s or %s to be set", mapStrictKey, uidMapKey, gidMapKey)
+	}
+
+	if li.preserveXattrs && li.tarFormat != tar.FormatUnknown && li.tarFormat != tar.FormatPAX {
+		return nil, errors.Errorf("%s requires %s=pax: %s does not support extended attributes", preserveXattrsKey, tarFormatKey, li.tarFormat)
+	}
+	if li.preserveCaps && li.tarFormat != tar.FormatUnknown && li.tarFormat != tar.FormatPAX {
+		return nil, errors.Errorf("%s requires %s=pax: %s does not support extended attributes", preserveCapsKey, tarFormatKey, li.tarFormat)
+	}
+	if li.syncDir && li.outputType != outputTypeDir {
+		return nil, errors.Errorf("%s requires %s=%s", syncKey, outputTypeKey, outputTypeDir)
+	}
+	if li.capsStrict {
+		if !li.preserveCaps {
+			return nil, errors.Errorf("%s requires %s to be set", capsStrictKey, preserveCapsKey)
+		}
+		if li.outputType == outputTypeDir {
+			// the sync target applies capabilities best-effort, depending
+			// on the client's privilege
+			return nil, errors.Errorf("%s cannot be combined with %s=%s", capsStrictKey, outputTypeKey, outputTypeDir)
+		}
+	}
+
+	if li.splitSize > 0 && li.outputType == outputTypeDir {
+		return nil, errors.Errorf("%s cannot be combined with %s=%s", splitSizeKey, outputTypeKey, outputTypeDir)
+	}
+
+	if li.outputType == outputTypeDir && li.compression != "" {
+		return nil, errors.Errorf("%s=%s cannot be combined with %s", outputTypeKey, outputTypeDir, compressionKey)
+	}
+
+	if li.compressionLevel != nil {
+		switch li.compression {
+		case "gzip":
+			if *li.compressionLevel < gzip.BestSpeed || *li.compressionLevel > gzip.BestCompression {
+				return nil, errors.Errorf("invalid %s %d for gzip: must be between %d and %d", compressionLevelKey, *li.compressionLevel, gzip.BestSpeed, gzip.BestCompression)
+			}
+		case "zstd":
+			if *li.compressionLevel < 1 || *li.compressionLevel > 22 {
+				return nil, errors.Errorf("invalid %s %d for zstd: must be between 1 and 22", compressionLevelKey, *li.compressionLevel)
+			}
+		case "lz4":
+			if *li.compressionLevel < 0 || *li.compressionLevel > 9 {
+				return nil, errors.Errorf("invalid %s %d for lz4: must be between 0 (fast) and 9", compressionLevelKey, *li.compressionLevel)
+			}
+		default:
+			return nil, errors.Errorf("%s requires %s to be set", compressionLevelKey, compressionKey)
+		}
+	}
+
+	if li.compressionThreads > 0 && li.compression == "" {
+		return nil, errors.Errorf("%s requires %s to be set", compressionThreadsKey, compressionKey)
+	}
+
+	if li.zstdDictURL != "" && li.compression != "zstd" {
+		return nil, errors.Errorf("%s requires %s=zstd", zstdDictKey, compressionKey)
+	}
+
+	if li.align > 0 && li.recordSize > 0 {
+		return nil, errors.Errorf("%s cannot be combined with %s", alignKey, tarBlockingFactorKey)
+	}
+
+	li.resolvedOpts = opt
+
+	return li, nil
+}
+
+type localExporterInstance struct {
+	*localExporter
+	opts local.CreateFSOpts
+	// headerMutator is copied from Opt at Resolve time; see HeaderMutator
+	headerMutator      HeaderMutator
+	preferNonDist      bool
+	compression        string
+	compressionLevel   *int
+	compressionThreads int
+	// zstdDictURL names the session upload carrying the dictionary;
+	// zstdDict holds the fetched blob once loadZstdDict has validated it
+	zstdDictURL         string
+	zstdDict            []byte
+	deterministic       bool
+	strictDeterministic bool
+	outputType          string
+	splitSize           int64
+	// fanoutSessions lists extra sessions receiving a copy of the
+	// tarball; fanoutPolicy selects the drop-or-error handling for them
+	fanoutSessions []string
+	fanoutPolicy   string
+	// suggestFilename returns an advisory download name in the metadata
+	suggestFilename bool
+	// writeBufferSize buffers writes to the client stream, zero meaning
+	// unbuffered
+	writeBufferSize  int
+	tarFormat        tar.Format
+	index            bool
+	bom              bool
+	preserveXattrs   bool
+	preserveCaps     bool
+	capsStrict       bool
+	stripSpecialBits bool
+	dedupHardlinks   bool
+	dedupContent     bool
+	chmodRules       []chmodRule
+	textEOL          string
+	textEOLMatcher   *patternmatcher.PatternMatcher
+	symlinkMode      string
+	brokenSymlinks   string
+	syncDir          bool
+	specialFiles     string
+	checksums        string
+	whiteoutMode     string
+	outputURL        string
+	outputHeaders    map[string]string
+	allowEmpty       bool
+	platformNested   bool
+	sparse           bool
+	pruneEmptyDirs   bool
+	keepEmptyDirs    []string
+	caseFold         string
+	ociLayout        bool
+	dryRun           bool
+	annotations      map[string]string
+	indexAnnotations map[string]string
+	uidMap           []idMapEntry
+	gidMap           []idMapEntry
+	mapStrict        bool
+	pathPrefix       string
+	computeDigest    bool
+	sessionTimeout   time.Duration
+	sessionRetries   int
+	progressInterval time.Duration
+	progressName     string
+	// perPlatformProgress reports a child transfer status per platform on
+	// the streaming write path
+	perPlatformProgress bool
+	writeMetadataPath   string
+	diffBase            string
+	defaultPlatform     string
+	// hostPlatformLink names a root symlink pointing at the platform dir
+	// matching the client's host platform; requireHostPlatform turns a
+	// missing match into an error instead of omitting the link
+	hostPlatformLink    string
+	requireHostPlatform bool
+	recordSize          int64
+	align               int64
+	formatSet           bool
+	outputFormats       []string
+	verify              bool
+	defaultUname        string
+	defaultGname        string
+	unameMap            map[int]string
+	gnameMap            map[int]string
+	maxFileSize         int64
+	maxTotalSize        int64
+	expectFiles         *int
+	// rootMode/rootUID/rootGID override the header of the synthetic
+	// platform directory; nil mode means the default 0755
+	rootMode     *os.FileMode
+	rootUID      int
+	rootGID      int
+	resolvedOpts map[string]string
+	stream       bool
+	// platformEpochs overrides the global epoch for individual platforms
+	platformEpochs map[string]*time.Time
+	// formatEpochs overrides the global epoch per output format; see
+	// formatEpochKeyPrefix for precedence
+	formatEpochs map[string]*time.Time
+	// platformSeparator replaces "/" in platform subdir names; empty means "_"
+	platformSeparator string
+	// platformTemplate names platform subdirs from platform fields;
+	// platformNames holds the expanded, validated names per platform ID
+	platformTemplate string
+	platformNames    map[string]string
+	// platformFilter limits a multi-platform export to the listed specs
+	platformFilter []string
+	// singlePlatformFlatten unwraps the platform subdir when exactly one
+	// platform remains after filtering
+	singlePlatformFlatten bool
+	// attestationsOutput selects inline (default) or separate delivery
+	attestationsOutput string
+	attestationsOnly   bool
+}
+
+// filterPlatforms returns the subset of in matching the configured platform
+// filter, preserving order. Every requested spec must match at least one
+// platform in the result.
+func (e *localExporterInstance) filterPlatforms(in []exptypes.Platform) ([]exptypes.Platform, error) {
+	type matcherSpec struct {
+		spec    string
+		matcher platforms.Matcher
+	}
+	matchers := make([]matcherSpec, 0, len(e.platformFilter))
+	for _, spec := range e.platformFilter {
+		pl, err := platforms.Parse(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid platform in %s: %s", platformsKey, spec)
+		}
+		matchers = append(matchers, matcherSpec{spec: spec, matcher: platforms.OnlyStrict(pl)})
+	}
+	matched := make([]bool, len(matchers))
+	var out []exptypes.Platform
+	for _, pp := range in {
+		keep := false
+		for i, m := range matchers {
+			if pp.ID == m.spec || m.matcher.Match(pp.Platform) {
+				matched[i] = true
+				keep = true
+			}
+		}
+		if keep {
+			out = append(out, pp)
+		}
+	}
+	for i, m := range matchers {
+		if !matched[i] {
+			return nil, errors.Errorf("requested platform %s is not present in the result", m.spec)
+		}
+	}
+	return out, nil
+}
+
+// parseIDMap parses comma-separated container:host:size triples into id
+// mapping ranges.
+func parseIDMap(key, v string) ([]idMapEntry, error) {
+	var m []idMapEntry
+	for _, triple := range strings.Split(v, ",") {
+		triple = strings.TrimSpace(triple)
+		if triple == "" {
+			continue
+		}
+		parts := strings.Split(triple, ":")
+		if len(parts) != 3 {
+			return nil, errors.Errorf("invalid %s entry %q: expected container:host:size", key, triple)
+		}
+		var nums [3]int
+		for i, p := range parts {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s entry %q", key, triple)
+			}
+			if n < 0 {
+				return nil, errors.Errorf("invalid %s entry %q: negative value", key, triple)
+			}
+			nums[i] = n
+		}
+		if nums[2] == 0 {
+			return nil, errors.Errorf("invalid %s entry %q: size must be positive", key, triple)
+		}
+		m = append(m, idMapEntry{container: nums[0], host: nums[1], size: nums[2]})
+	}
+	if len(m) == 0 {
+		return nil, errors.Errorf("empty value for %s", key)
+	}
+	return m, nil
+}
+
+// parseChmodRules parses the comma or newline separated pattern=mode pairs
+// of the chmod option, validating both halves so a bad mode or pattern is
+// rejected at resolve time.
+func parseChmodRules(v string) ([]chmodRule, error) {
+	var rules []chmodRule
+	for _, f := range parsePatterns(v) {
+		pattern, modeStr, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid %s entry %q: expected pattern=mode", chmodKey, f)
+		}
+		mode, err := strconv.ParseInt(modeStr, 8, 32)
+		if err != nil || mode < 0 || mode > 07777 {
+			return nil, errors.Errorf("invalid octal mode for %s: %s", chmodKey, modeStr)
+		}
+		m, err := patternmatcher.New([]string{pattern})
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern for %s: %s", chmodKey, pattern)
+		}
+		rules = append(rules, chmodRule{matcher: m, mode: mode})
+	}
+	return rules, nil
+}
+
+// parseNameMap parses comma-separated id=name pairs, as used by the
+// uname-map and gname-map options.
+func parseNameMap(key, v string) (map[int]string, error) {
+	m := map[int]string{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idStr, name, ok := strings.Cut(part, "=")
+		if !ok || name == "" {
+			return nil, errors.Errorf("invalid value for %s: %s", key, part)
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid id in %s: %s", key, part)
+		}
+		m[id] = name
+	}
+	if len(m) == 0 {
+		return nil, errors.Errorf("empty value for %s", key)
+	}
+	return m, nil
+}
+
+// parsePatterns splits a newline- or comma-separated pattern list and
+// normalizes the entries. Trailing slashes on directory patterns are
+// stripped so they match the cleaned paths used by the pattern matcher.
+func parsePatterns(v string) []string {
+	var patterns []string
+	for _, p := range strings.FieldsFunc(v, func(r rune) bool {
+		return r == '\n' || r == ','
+	}) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		patterns = append(patterns, strings.TrimSuffix(p, "/"))
+	}
+	return patterns
+}
+
+// platformDirName derives the subdirectory name for a platform key, using
+// the expanded platform-template name when one is configured and otherwise
+// replacing path separators with the configured separator character.
+func (e *localExporterInstance) platformDirName(k string) string {
+	if e.platformNested {
+		return k
+	}
+	if name, ok := e.platformNames[k]; ok {
+		return name
+	}
+	sep := e.platformSeparator
+	if sep == "" {
+		sep = "_"
+	}
+	return strings.Replace(k, "/", sep, -1)
+}
+
+// rootDirMode returns the permission bits for the synthetic platform
+// directory, defaulting to 0755 when root-mode is unset.
+func (e *localExporterInstance) rootDirMode() os.FileMode {
+	if e.rootMode != nil {
+		return *e.rootMode
+	}
+	return 0755
+}
+
+var platformTemplatePlaceholders = []string{"{os}", "{arch}", "{variant}", "{osversion}"}
+
+func validatePlatformTemplate(tmpl string) error {
+	if tmpl == "" {
+		return errors.Errorf("empty value for %s", platformTemplateKey)
+	}
+	rest := tmpl
+	for _, ph := range platformTemplatePlaceholders {
+		rest = strings.ReplaceAll(rest, ph, "")
+	}
+	if i := strings.IndexAny(rest, "{}"); i != -1 {
+		return errors.Errorf("invalid %s %q: unknown placeholder", platformTemplateKey, tmpl)
+	}
+	if strings.ContainsAny(rest, "/") || strings.Contains(tmpl, "..") {
+		return errors.Errorf("invalid %s %q: must not contain path separators", platformTemplateKey, tmpl)
+	}
+	return nil
+}
+
+func expandPlatformTemplate(tmpl string, p exptypes.Platform) string {
+	return strings.NewReplacer(
+		"{os}", p.Platform.OS,
+		"{arch}", p.Platform.Architecture,
+		"{variant}", p.Platform.Variant,
+		"{osversion}", p.Platform.OSVersion,
+	).Replace(tmpl)
+}
+
+// resolvePlatformNames expands the platform-template for each platform and
+// verifies the resulting directory names are unique.
+func (e *localExporterInstance) resolvePlatformNames(platforms []exptypes.Platform) error {
+	if e.platformTemplate == "" {
+		return nil
+	}
+	names := make(map[string]string, len(platforms))
+	seen := map[string]string{}
+	for _, pp := range platforms {
+		name := expandPlatformTemplate(e.platformTemplate, pp)
+		if name == "" {
+			return errors.Errorf("%s produces empty name for platform %s", platformTemplateKey, pp.ID)
+		}
+		if prev, ok := seen[name]; ok {
+			return errors.Errorf("%s produces colliding name %q for platforms %s and %s", platformTemplateKey, name, prev, pp.ID)
+		}
+		seen[name] = pp.ID
+		names[pp.ID] = name
+	}
+	e.platformNames = names
+	return nil
+}
+
+func (e *localExporterInstance) Name() string {
+	if e.progressName != "" {
+		return e.progressName
+	}
+	return "exporting to client tarball"
+}
+
+// progressLabel is the id of the one-off sending status, following the
+// progress-name option when one is set.
+func (e *localExporterInstance) progressLabel() string {
+	if e.progressName != "" {
+		return e.progressName
+	}
+	return "sending tarball"
+}
+
+func (e *localExporterInstance) Config() *exporter.Config {
+	return exporter.NewConfig()
+}
+
+func (e *localExporterInstance) gzipLevel() int {
+	if e.compressionLevel != nil {
+		return *e.compressionLevel
+	}
+	return gzip.DefaultCompression
+}
+
+func (e *localExporterInstance) zstdLevel() zstd.EncoderLevel {
+	if e.compressionLevel != nil {
+		return zstd.EncoderLevelFromZstd(*e.compressionLevel)
+	}
+	return zstd.SpeedDefault
+}
+
+// loadZstdDict pulls the dictionary blob named by zstd-dict from the
+// client session and checks that the encoder accepts it, so a missing or
+// corrupt dictionary fails before any tar stream has opened.
+func (e *localExporterInstance) loadZstdDict(ctx context.Context, caller session.Caller) error {
+	u, err := url.Parse(e.zstdDictURL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid URL for %s: %s", zstdDictKey, e.zstdDictURL)
+	}
+	up, err := upload.New(ctx, caller, u)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s upload %s", zstdDictKey, e.zstdDictURL)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := up.WriteTo(buf); err != nil {
+		return errors.Wrapf(err, "failed to fetch %s dictionary %s", zstdDictKey, e.zstdDictURL)
+	}
+	dict := buf.Bytes()
+	if len(dict) == 0 {
+		return errors.Errorf("%s dictionary %s is empty", zstdDictKey, e.zstdDictURL)
+	}
+	zw, err := zstd.NewWriter(io.Discard, zstd.WithEncoderDict(dict))
+	if err != nil {
+		return errors.Wrapf(err, "invalid zstd dictionary from %s", e.zstdDictURL)
+	}
+	zw.Close()
+	e.zstdDict = dict
+	return nil
+}
+
+// compressionBlockSize is the block granularity of the parallel gzip
+// encoder. Each block is compressed independently, so larger blocks cost
+// less ratio but leave less work to parallelize over.
+const compressionBlockSize = 1 << 20
+
+// compressionWriter wraps w with the configured compression codec. Closing
+// the returned writer flushes and closes the codec before closing w, so it
+// is safe to call on error paths as well; for the concurrent encoders the
+// codec Close also waits for all worker goroutines to drain before the
+// underlying writer is closed. If no compression is configured, w is
+// returned unchanged.
+func (e *localExporterInstance) compressionWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	switch e.compression {
+	case "gzip":
+		if e.compressionThreads > 1 {
+			gz, err := pgzip.NewWriterLevel(w, e.gzipLevel())
+			if err != nil {
+				w.Close()
+				return nil, err
+			}
+			if err := gz.SetConcurrency(compressionBlockSize, e.compressionThreads); err != nil {
+				w.Close()
+				return nil, err
+			}
+			return &compressedWriter{Writer: gz, closers: []io.Closer{gz, w}}, nil
+		}
+		gz, err := gzip.NewWriterLevel(w, e.gzipLevel())
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		return &compressedWriter{Writer: gz, closers: []io.Closer{gz, w}}, nil
+	case "zstd":
+		opts := []zstd.EOption{zstd.WithEncoderLevel(e.zstdLevel())}
+		if e.compressionThreads > 0 {
+			opts = append(opts, zstd.WithEncoderConcurrency(e.compressionThreads))
+		}
+		if len(e.zstdDict) > 0 {
+			opts = append(opts, zstd.WithEncoderDict(e.zstdDict))
+		}
+		zw, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		return &compressedWriter{Writer: zw, closers: []io.Closer{zw, w}}, nil
+	case "lz4":
+		lw := lz4.NewWriter(w)
+		var opts []lz4.Option
+		if e.compressionLevel != nil {
+			opts = append(opts, lz4.CompressionLevelOption(lz4Level(*e.compressionLevel)))
+		}
+		if e.compressionThreads > 0 {
+			opts = append(opts, lz4.ConcurrencyOption(e.compressionThreads))
+		}
+		if len(opts) > 0 {
+			if err := lw.Apply(opts...); err != nil {
+				w.Close()
+				return nil, err
+			}
+		}
+		return &compressedWriter{Writer: lw, closers: []io.Closer{lw, w}}, nil
+	}
+	return w, nil
+}
+
+// lz4Level maps the 0-9 compression-level range onto the encoder's level
+// constants, 0 being the fast default. The range is validated in Resolve.
+func lz4Level(n int) lz4.CompressionLevel {
+	levels := []lz4.CompressionLevel{
+		lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4,
+		lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+	}
+	return levels[n]
+}
+
+// bufferWriter wraps a client stream writer in a bufio.Writer of the
+// configured write-buffer-size, a no-op when the option is unset. Close
+// flushes the buffer before closing the stream.
+func (e *localExporterInstance) bufferWriter(w io.WriteCloser) io.WriteCloser {
+	if e.writeBufferSize <= 0 {
+		return w
+	}
+	return &bufferedWriteCloser{bw: bufio.NewWriterSize(w, e.writeBufferSize), c: w}
+}
+
+type bufferedWriteCloser struct {
+	bw *bufio.Writer
+	c  io.Closer
+}
+
+func (b *bufferedWriteCloser) Write(p []byte) (int, error) {
+	return b.bw.Write(p)
+}
+
+func (b *bufferedWriteCloser) Close() error {
+	err := b.bw.Flush()
+	if err1 := b.c.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+type compressedWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (w *compressedWriter) Close() error {
+	var rerr error
+	for _, c := range w.closers {
+		if err := c.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	return rerr
+}
+
+// getCaller acquires the client session within the configured timeout,
+// retrying transient failures because a client that just reconnected may
+// not have registered its session yet.
+func (e *localExporterInstance) getCaller(ctx context.Context, sessionID string) (session.Caller, error) {
+	sessionTimeout := e.sessionTimeout
+	if sessionTimeout == 0 {
+		sessionTimeout = defaultSessionTimeout
+	}
+	attempts := e.sessionRetries
+	if attempts == 0 {
+		attempts = defaultSessionRetries
+	}
+	return getCallerWithRetry(ctx, e.opt.SessionManager, sessionID, sessionTimeout, attempts)
+}
+
+// sessionGetter is the subset of session.Manager used by getCallerWithRetry.
+type sessionGetter interface {
+	Get(ctx context.Context, id string, noWait bool) (session.Caller, error)
+}
+
+// getCallerWithRetry attempts Get up to attempts times, each within its
+// own timeout, backing off exponentially between attempts. Cancellation
+// of the parent context stops the retries immediately rather than being
+// treated as one more transient failure.
+func getCallerWithRetry(ctx context.Context, sm sessionGetter, sessionID string, timeout time.Duration, attempts int) (session.Caller, error) {
+	backoff := 100 * time.Millisecond
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+		var caller session.Caller
+		caller, err = sm.Get(timeoutCtx, sessionID, false)
+		cancel()
+		if err == nil {
+			return caller, nil
+		}
+		if ctx.Err() != nil {
+			// the export itself was cancelled, not a session hiccup
+			return nil, err
+		}
+	}
+	return nil, errors.Wrapf(err, "failed to get session after %d attempts", attempts)
+}
+
+func (e *localExporterInstance) writeTarOpts() writeTarOpts {
+	checksumMtime := e.now().Truncate(time.Second)
+	if e.opts.Epoch != nil {
+		checksumMtime = *e.opts.Epoch
+	}
+	return writeTarOpts{
+		checksums:           e.checksums,
+		checksumMtime:       checksumMtime,
+		maxFileSize:         e.maxFileSize,
+		maxTotalSize:        e.maxTotalSize,
+		expectFiles:         e.expectFiles,
+		recordSize:          e.recordSize,
+		align:               e.align,
+		defaultUname:        e.defaultUname,
+		defaultGname:        e.defaultGname,
+		unameMap:            e.unameMap,
+		gnameMap:            e.gnameMap,
+		deterministic:       e.deterministic,
+		strictDeterministic: e.strictDeterministic,
+		epochPinned:         e.opts.Epoch != nil,
+		format:              e.tarFormat,
+		preserveXattrs:      e.preserveXattrs,
+		preserveCaps:        e.preserveCaps,
+		stripSpecialBits:    e.stripSpecialBits,
+		dedupHardlinks:      e.dedupHardlinks || e.dedupContent,
+		chmodRules:          e.chmodRules,
+		textEOL:             e.textEOL,
+		textEOLMatcher:      e.textEOLMatcher,
+		sparse:              e.sparse,
+		pruneEmptyDirs:      e.pruneEmptyDirs,
+		keepEmptyDirs:       e.keepEmptyDirs,
+		caseFold:            e.caseFold,
+		symlinkMode:         e.symlinkMode,
+		brokenSymlinks:      e.brokenSymlinks,
+		specialFiles:        e.specialFiles,
+		whiteoutMode:        e.whiteoutMode,
+		uidMap:              e.uidMap,
+		gidMap:              e.gidMap,
+		mapStrict:           e.mapStrict,
+		headerMutator:       e.headerMutator,
+	}
+}
+
+// wrapPathPrefix nests fs under the configured path-prefix by stacking one
+// synthetic directory per prefix segment. The synthetic directories use the
+// pinned epoch mtime when one is set.
+func (e *localExporterInstance) wrapPathPrefix(fs fsutil.FS, defaultTime time.Time) (fsutil.FS, error) {
+	segments := strings.Split(e.pathPrefix, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		st := fstypes.Stat{
+			Mode:    uint32(os.ModeDir | 0755),
+			Path:    segments[i],
+			ModTime: defaultTime.UnixNano(),
+		}
+		if e.opts.Epoch != nil {
+			st.ModTime = e.opts.Epoch.UnixNano()
+		}
+		var err error
+		fs, err = fsutil.SubDirFS([]fsutil.Dir{{FS: fs, Stat: st}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// indexEntry describes one exported platform in the optional index.json
+// entry written at the root of multi-platform tarballs.
+type indexEntry struct {
+	ID       string            `json:"id"`
+	Platform ocispecs.Platform `json:"platform"`
+	Path     string            `json:"path"`
+	// Epoch is the effective source date epoch of this platform's tree:
+	// the per-platform override when one is set, the global epoch
+	// otherwise. Omitted when no epoch is pinned, so consumers can verify
+	// reproducibility per arch from the index alone.
+	Epoch *time.Time `json:"epoch,omitempty"`
+}
+
+func (e *localExporterInstance) addPlatformIndex(fs fsutil.FS, platforms []exptypes.Platform, defaultTime time.Time) (fsutil.FS, error) {
+	entries := make([]indexEntry, 0, len(platforms))
+	for _, p := range platforms {
+		epoch := e.opts.Epoch
+		if tm, ok := e.platformEpochs[p.ID]; ok {
+			epoch = tm
+		}
+		entries = append(entries, indexEntry{
+			ID:       p.ID,
+			Platform: p.Platform,
+			Path:     e.platformDirName(p.ID),
+			Epoch:    epoch,
+		})
+	}
+	dt, err := json.Marshal(entries)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal platform index")
+	}
+	st := fstypes.Stat{
+		Mode:    0644,
+		Path:    indexFileName,
+		ModTime: defaultTime.UnixNano(),
+	}
+	if e.opts.Epoch != nil {
+		st.ModTime = e.opts.Epoch.UnixNano()
+	}
+	idxFS := staticfs.NewFS()
+	idxFS.Add(indexFileName, st, dt)
+	return staticfs.NewMergeFS(fs, idxFS), nil
+}
+
+// addBOMFile merges a bom.json entry into fs, mapping each exported
+// platform ID to the content digest of its subtree. The digest is taken
+// over the subtree serialized as an uncompressed tar with the export's
+// write options, before the platform prefix is applied, so re-tarring an
+// extracted subtree the same way reproduces it. The entry's mtime follows
+// the export epoch when one is pinned.
+func (e *localExporterInstance) addBOMFile(ctx context.Context, fs fsutil.FS, dirs []fsutil.Dir, platforms []exptypes.Platform, defaultTime time.Time) (fsutil.FS, error) {
+	twOpts := e.writeTarOpts()
+	digests := make(map[string]digest.Digest, len(platforms))
+	for i, p := range platforms {
+		d := digest.Canonical.Digester()
+		if err := writeTar(ctx, dirs[i].FS, d.Hash(), twOpts); err != nil {
+			return nil, errors.Wrapf(err, "failed to digest subtree of %s", p.ID)
+		}
+		digests[p.ID] = d.Digest()
+	}
+	dt, err := json.Marshal(digests)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal platform BOM")
+	}
+	st := fstypes.Stat{
+		Mode:    0644,
+		Path:    bomFileName,
+		ModTime: defaultTime.UnixNano(),
+	}
+	if e.opts.Epoch != nil {
+		st.ModTime = e.opts.Epoch.UnixNano()
+	}
+	bomFS := staticfs.NewFS()
+	bomFS.Add(bomFileName, st, dt)
+	return staticfs.NewMergeFS(fs, bomFS), nil
+}
+
+// addHostPlatformLink merges the host-platform-link symlink entry into fs,
+// pointing at the subdirectory of the platform that matches the client's
+// host platform. The entry is skipped when no platform matches, unless
+// require-host-platform is set.
+func (e *localExporterInstance) addHostPlatformLink(fs fsutil.FS, caller session.Caller, pls []exptypes.Platform, defaultTime time.Time) (fsutil.FS, error) {
+	for _, pp := range pls {
+		if e.platformDirName(pp.ID) == e.hostPlatformLink {
+			return nil, errors.Errorf("%s %q collides with the directory of platform %s", hostPlatformLinkKey, e.hostPlatformLink, pp.ID)
+		}
+	}
+	target, err := e.resolveHostPlatformDir(caller, pls)
+	if err != nil {
+		return nil, err
+	}
+	if target == "" {
+		return fs, nil
+	}
+	st := fstypes.Stat{
+		Mode:     uint32(os.ModeSymlink | 0777),
+		Path:     e.hostPlatformLink,
+		Linkname: target,
+		ModTime:  defaultTime.UnixNano(),
+	}
+	if e.opts.Epoch != nil {
+		st.ModTime = e.opts.Epoch.UnixNano()
+	}
+	linkFS := staticfs.NewFS()
+	linkFS.Add(e.hostPlatformLink, st, nil)
+	return staticfs.NewMergeFS(fs, linkFS), nil
+}
+
+// resolveHostPlatformDir returns the directory name of the exported
+// platform matching the platform the client reported for its host, or an
+// empty string when the client reported none or no platform matches.
+func (e *localExporterInstance) resolveHostPlatformDir(caller session.Caller, pls []exptypes.Platform) (string, error) {
+	hostStr := caller.HostPlatform()
+	if hostStr == "" {
+		if e.requireHostPlatform {
+			return "", errors.Errorf("%s: client did not report its host platform", requireHostPlatformKey)
+		}
+		return "", nil
+	}
+	host, err := platforms.Parse(hostStr)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid client host platform %q", hostStr)
+	}
+	matcher := platforms.Only(platforms.Normalize(host))
+	for _, pp := range pls {
+		if matcher.Match(platforms.Normalize(pp.Platform)) {
+			return e.platformDirName(pp.ID), nil
+		}
+	}
+	if e.requireHostPlatform {
+		return "", errors.Errorf("client host platform %s is not among the exported platforms", platforms.Format(host))
+	}
+	return "", nil
+}
+
+// addOptionsMetadata records the options the instance resolved with under
+// the export.options metadata key, with credentials redacted.
+func (e *localExporterInstance) addOptionsMetadata(md map[string]string) error {
+	if len(e.resolvedOpts) == 0 {
+		return nil
+	}
+	opts := make(map[string]string, len(e.resolvedOpts))
+	for k, v := range e.resolvedOpts {
+		switch {
+		case k == outputURLKey:
+			if u, err := url.Parse(v); err == nil {
+				v = u.Redacted()
+			}
+		case strings.HasPrefix(k, outputHeaderKeyPrefix):
+			// header values routinely carry bearer tokens
+			v = "xxxxx"
+		}
+		opts[k] = v
+	}
+	dt, err := json.Marshal(opts)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal export options")
+	}
+	md[exporterOptionsKey] = string(dt)
+	return nil
+}
+
+// exportMetadata is the document written by the write-metadata option,
+// recording how the export was produced.
+type exportMetadata struct {
+	Platforms []exptypes.Platform `json:"platforms,omitempty"`
+	Options   map[string]string   `json:"options,omitempty"`
+	Epoch     *time.Time          `json:"epoch,omitempty"`
+}
+
+// addMetadataFile merges the write-metadata JSON document into fs at the
+// configured path, creating parent directory entries as needed. The entry
+// mtime follows the pinned epoch when one is set.
+func (e *localExporterInstance) addMetadataFile(fs fsutil.FS, platforms []exptypes.Platform, defaultTime time.Time) (fsutil.FS, error) {
+	dt, err := json.MarshalIndent(exportMetadata{
+		Platforms: platforms,
+		Options:   e.resolvedOpts,
+		Epoch:     e.opts.Epoch,
+	}, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal export metadata")
+	}
+
+	mtime := defaultTime.UnixNano()
+	if e.opts.Epoch != nil {
+		mtime = e.opts.Epoch.UnixNano()
+	}
+
+	mdFS := staticfs.NewFS()
+	segments := strings.Split(e.writeMetadataPath, "/")
+	for i := range segments[:len(segments)-1] {
+		dir := strings.Join(segments[:i+1], "/")
+		mdFS.Add(dir, fstypes.Stat{
+			Mode:    uint32(os.ModeDir | 0755),
+			Path:    dir,
+			ModTime: mtime,
+		}, nil)
+	}
+	mdFS.Add(e.writeMetadataPath, fstypes.Stat{
+		Mode:    0644,
+		Path:    e.writeMetadataPath,
+		ModTime: mtime,
+	}, dt)
+	return staticfs.NewMergeFS(fs, mdFS), nil
+}
+
+func (e *localExporterInstance) Export(ctx context.Context, inp *exporter.Source, sessionID string) (map[string]string, error) {
+	start := e.now()
+	var mu sync.Mutex
+	var defers []func() error
+
+	defer func() {
+		for i := len(defers) - 1; i >= 0; i-- {
+			defers[i]()
+		}
+	}()
+
+	if e.opts.Epoch == nil {
+		if tm, ok, err := epoch.ParseSource(inp); err != nil {
+			return nil, err
+		} else if ok {
+			e.opts.Epoch = tm
+		}
+	}
+	if e.opts.ClampMtime && e.opts.Epoch == nil {
+		return nil, errors.Errorf("%s requires %s to be set", clampMtimeKey, epoch.KeySourceDateEpoch)
+	}
+
+	// an empty source would silently produce a zero-byte tarball, which
+	// tends to confuse downstream extract steps; make it an explicit
+	// opt-in. With allow-empty=true the normal path below serializes an
+	// empty directory into a valid (headers-only) tar.
+	if isEmptySource(inp) && !e.allowEmpty {
+		return nil, errors.Errorf("nothing to export: build produced no output (set %s=true to export an empty tarball)", allowEmptyKey)
+	}
+
+	// the fallback mtime for synthetic entries is intentionally
+	// seconds-only; sub-second precision requires an explicit epoch
+	now := e.now().Truncate(time.Second)
+
+	separateAttestations := e.attestationsOutput == attestationsOutputSeparate
+
+	if len(inp.Refs) > 0 {
+		e.opts.Mounts = local.NewSharedMounts()
+	}
+
+	getDir := func(ctx context.Context, k string, ref cache.ImmutableRef, attestations []result.Attestation) (*fsutil.Dir, *fsutil.Dir, error) {
+		opts := e.opts
+		// most specific epoch wins: platform, then rootfs format, then
+		// the global one already in opts
+		if tm, ok := e.formatEpochs[formatRootfs]; ok {
+			opts.Epoch = tm
+		}
+		if tm, ok := e.platformEpochs[k]; ok {
+			opts.Epoch = tm
+		}
+		if strings.Contains(opts.AttestationPrefix, attestationPlatformPlaceholder) {
+			prefix, err := local.ValidateAttestationPrefix(strings.ReplaceAll(opts.AttestationPrefix, attestationPlatformPlaceholder, e.platformDirName(k)))
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid %s after platform expansion", attestationPrefixKey)
+			}
+			opts.AttestationPrefix = prefix
+		}
+		if separateAttestations || e.attestationsOnly {
+			// the rootfs walk below is still needed for subject digests,
+			// but the attestation files are assembled separately
+			opts.SkipAttestations = true
+		}
+		outputFS, cleanup, err := local.CreateFS(ctx, sessionID, k, ref, inp.Refs, attestations, now, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cleanup != nil {
+			mu.Lock()
+			defers = append(defers, cleanup)
+			mu.Unlock()
+		}
+
+		st := fstypes.Stat{
+			Mode: uint32(os.ModeDir | e.rootDirMode()),
+			Path: e.platformDirName(k),
+			Uid:  uint32(e.rootUID),
+			Gid:  uint32(e.rootGID),
+		}
+		if opts.Epoch != nil {
+			st.ModTime = opts.Epoch.UnixNano()
+		}
+
+		if e.attestationsOnly {
+			attFS, err := local.CreateAttestationsFS(ctx, sessionID, inp.Refs, attestations, outputFS, now, opts)
+			if err != nil {
+				return nil, nil, err
+			}
+			if attFS == nil {
+				return nil, nil, errors.Errorf("%s: build produced no attestations to export", attestationsOnlyKey)
+			}
+			// the attestation documents replace the rootfs as the export
+			// content; the rootfs itself is never serialized
+			return &fsutil.Dir{FS: attFS, Stat: st}, nil, nil
+		}
+
+		var attDir *fsutil.Dir
+		if separateAttestations {
+			attFS, err := local.CreateAttestationsFS(ctx, sessionID, inp.Refs, attestations, outputFS, now, opts)
+			if err != nil {
+				return nil, nil, err
+			}
+			if attFS == nil {
+				attFS = staticfs.NewFS()
+			}
+			attDir = &fsutil.Dir{FS: attFS, Stat: st}
+		}
+
+		return &fsutil.Dir{
+			FS:   outputFS,
+			Stat: st,
+		}, attDir, nil
+	}
+
+	isMap := len(inp.Refs) > 0
+
+	platformsBytes, ok := inp.Metadata[exptypes.ExporterPlatformsKey]
+	if len(inp.Refs) > 0 && !ok {
+		return nil, errors.Errorf("unable to export multiple refs, missing platforms mapping")
+	}
+
+	var p exptypes.Platforms
+	if ok && len(platformsBytes) > 0 {
+		if err := json.Unmarshal(platformsBytes, &p); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse platforms passed to exporter")
+		}
+		if len(p.Platforms) == 0 {
+			// some buggy frontends set the key with an empty list; without
+			// this check the map branch below would silently produce an
+			// empty archive
+			if len(inp.Refs) > 1 {
+				return nil, errors.Errorf("platforms metadata present but empty")
+			}
+			for id := range inp.Refs {
+				p.Platforms = append(p.Platforms, exptypes.Platform{ID: id})
+			}
+			isMap = false
+		}
+		if len(e.platformFilter) > 0 {
+			filtered, err := e.filterPlatforms(p.Platforms)
+			if err != nil {
+				return nil, err
+			}
+			p.Platforms = filtered
+		}
+		if len(p.Platforms) > 1 {
+			isMap = true
+		}
+	}
+
+	if e.opts.MultiPlatform != nil {
+		isMap = *e.opts.MultiPlatform
+	}
+	if e.singlePlatformFlatten && len(p.Platforms) == 1 {
+		isMap = false
+	}
+	if !isMap && len(p.Platforms) > 1 {
+		return nil, errors.Errorf("unable to export multiple platforms without map")
+	}
+
+	if err := e.resolvePlatformNames(p.Platforms); err != nil {
+		return nil, err
+	}
+
+	// the host-platform-link target depends on the platform the client
+	// reports in its session metadata, so the session is needed before the
+	// filesystem is assembled; acquiring it here is also reused later
+	var caller session.Caller
+	if e.hostPlatformLink != "" && isMap {
+		var err error
+		caller, err = e.getCaller(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+	} else if e.hostPlatformLink != "" && e.requireHostPlatform {
+		return nil, errors.Errorf("%s requires a multi-platform export", requireHostPlatformKey)
+	}
+
+	// the dictionary comes from the client session, so it has to be
+	// fetched and validated before any stream opens; this also covers the
+	// split, format and upload paths which all share compressionWriter
+	if e.zstdDictURL != "" && !e.dryRun {
+		if caller == nil {
+			var err error
+			caller, err = e.getCaller(ctx, sessionID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := e.loadZstdDict(ctx, caller); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.stream && isMap && len(inp.Refs) > 0 && !e.dryRun {
+		return e.exportStream(ctx, inp, sessionID, p.Platforms, now, start)
+	}
+
+	var fs fsutil.FS
+	var attFS fsutil.FS
+	var layoutFSs []fsutil.FS
+
+	if len(inp.Refs) > 0 {
+		if !isMap {
+			pp, err := e.pickPlatform(p.Platforms)
+			if err != nil {
+				return nil, err
+			}
+			r, ok := inp.Refs[pp.ID]
+			if !ok {
+				return nil, errors.Errorf("failed to find ref for ID %s", pp.ID)
+			}
+			d, ad, err := getDir(ctx, pp.ID, r, inp.Attestations[pp.ID])
+			if err != nil {
+				return nil, err
+			}
+			fs = d.FS
+			if ad != nil {
+				attFS = ad.FS
+			}
+		} else {
+			// mount and walk the refs concurrently; mounting a snapshot can
+			// be slow, so don't serialize across platforms. Refs sharing a
+			// snapshot chain reuse one mount via the SharedMounts pool.
+			dirs := make([]fsutil.Dir, len(p.Platforms))
+			attDirs := make([]fsutil.Dir, len(p.Platforms))
+			eg, egCtx := errgroup.WithContext(ctx)
+			eg.SetLimit(runtime.NumCPU())
+			for i, pp := range p.Platforms {
+				i, pp := i, pp
+				r, ok := inp.Refs[pp.ID]
+				if !ok {
+					return nil, errors.Errorf("failed to find ref for ID %s", pp.ID)
+				}
+				eg.Go(func() error {
+					d, ad, err := getDir(egCtx, pp.ID, r, inp.Attestations[pp.ID])
+					if err != nil {
+						return err
+					}
+					dirs[i] = *d
+					if ad != nil {
+						attDirs[i] = *ad
+					}
+					return nil
+				})
+			}
+			if err := eg.Wait(); err != nil {
+				return nil, err
+			}
+			if e.ociLayout || e.wantsFormat(formatOCI) {
+				fss := make([]fsutil.FS, len(dirs))
+				for i := range dirs {
+					fss[i] = dirs[i].FS
+				}
+				layoutFSs = fss
+			}
+			if !e.ociLayout {
+				subDirFS := fsutil.SubDirFS
+				if e.platformNested {
+					subDirFS = func(dirs []fsutil.Dir) (fsutil.FS, error) {
+						return nestPlatformDirs(dirs, now, e.opts.Epoch)
+					}
+				}
+				var err error
+				fs, err = subDirFS(dirs)
+				if err != nil {
+					return nil, err
+				}
+				if separateAttestations {
+					attFS, err = subDirFS(attDirs)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if e.index {
+					fs, err = e.addPlatformIndex(fs, p.Platforms, now)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if e.bom {
+					fs, err = e.addBOMFile(ctx, fs, dirs, p.Platforms, now)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if e.hostPlatformLink != "" {
+					fs, err = e.addHostPlatformLink(fs, caller, p.Platforms, now)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	} else {
+		d, ad, err := getDir(ctx, "", inp.Ref, nil)
+		if err != nil {
+			return nil, err
+		}
+		fs = d.FS
+		if ad != nil {
+			attFS = ad.FS
+		}
+	}
+
+	if e.diffBase != "" {
+		if isMap {
+			return nil, errors.Errorf("%s requires a single-platform export", diffBaseKey)
+		}
+		baseRef, ok := inp.Refs[e.diffBase]
+		if !ok {
+			return nil, errors.Errorf("failed to find ref %s for %s", e.diffBase, diffBaseKey)
+		}
+		baseFS, cleanup, err := local.CreateFS(ctx, sessionID, e.diffBase, baseRef, inp.Refs, nil, now, e.opts)
+		if err != nil {
+			return nil, err
+		}
+		if cleanup != nil {
+			mu.Lock()
+			defers = append(defers, cleanup)
+			mu.Unlock()
+		}
+		fs = newDiffFS(baseFS, fs)
+	}
+
+	if e.ociLayout {
+		if layoutFSs == nil {
+			layoutFSs = []fsutil.FS{fs}
+		}
+		var err error
+		fs, err = ociLayoutFS(ctx, p.Platforms, layoutFSs, e.formatEpoch(formatOCI), now, e.writeTarOpts(), e.annotations, e.indexAnnotations)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if e.pathPrefix != "" {
+		var err error
+		fs, err = e.wrapPathPrefix(fs, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if e.writeMetadataPath != "" {
+		var err error
+		fs, err = e.addMetadataFile(fs, p.Platforms, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if e.dryRun {
+		return dryRunMetadata(ctx, fs, p.Platforms)
+	}
+
+	if e.outputURL != "" {
+		md := map[string]string{}
+		if err := e.addOptionsMetadata(md); err != nil {
+			return nil, err
+		}
+		if e.stripSpecialBits {
+			md[exporterSpecialBitsStrippedKey] = "true"
+		}
+		if err := e.uploadTar(ctx, fs); err != nil {
+			return nil, err
+		}
+		return md, nil
+	}
+
+	if caller == nil {
+		var err error
+		caller, err = e.getCaller(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sizeEstimate := estimateSize(ctx, inp)
+
+	if len(e.outputFormats) > 0 {
+		return e.exportFormats(ctx, caller, fs, layoutFSs, p.Platforms, now)
+	}
+
+	if e.outputType == outputTypeDir {
+		progress := local.NewProgressHandler(ctx, "copying files", e.progressOpt("", sizeEstimate))
+		copyToCaller := filesync.CopyToCaller
+		if e.syncDir {
+			copyToCaller = filesync.CopyToCallerSynced
+		}
+		if err := copyToCaller(ctx, fs, caller, progress); err != nil {
+			return nil, errors.Wrap(err, "failed to sync files to client directory")
+		}
+		return nil, nil
+	}
+
+	report := progress.OneOff(ctx, e.progressLabel())
+
+	twOpts := e.writeTarOpts()
+
+	md := map[string]string{}
+	if err := e.addOptionsMetadata(md); err != nil {
+		return nil, err
+	}
+	if e.stripSpecialBits {
+		md[exporterSpecialBitsStrippedKey] = "true"
+	}
+	if e.suggestFilename {
+		md[exporterSuggestedNameKey] = e.suggestedFilename(p.Platforms)
+	}
+
+	summary := &progress.ExportSummary{}
+	emitSummary := func(err error) error {
+		e.emitExportSummary(ctx, start, summary, err)
+		return report(err)
+	}
+
+	if e.splitSize > 0 {
+		part := 0
+		newPart := func() (io.WriteCloser, error) {
+			// the part index rides on the stream metadata so the filesync
+			// target can commit each part as its stream closes
+			w, err := filesync.CopyFileWriter(ctx, map[string]string{exporterPartKey: strconv.Itoa(part)}, caller)
+			if err != nil {
+				return nil, err
+			}
+			part++
+			return e.compressionWriter(e.bufferWriter(w))
+		}
+		sizes, nfiles, err := writeTarParts(ctx, fs, twOpts, newPart, e.splitSize)
+		summary.Files = int64(nfiles)
+		for _, n := range sizes {
+			// part sizes count the tar stream before compression; the
+			// bytes on the wire are not tracked on the split path
+			summary.BytesUncompressed += n
+		}
+		if e.compression == "" {
+			summary.BytesWritten = summary.BytesUncompressed
+		}
+		if err != nil {
+			if len(sizes) == 0 {
+				return nil, emitSummary(err)
+			}
+			// parts closed before the failure are already committed on
+			// the client; report them alongside the error so only the
+			// in-progress part is lost and a later export can resume
+			// part-by-part
+			md[exporterPartsKey] = strconv.Itoa(len(sizes))
+			if sizesJSON, jsonErr := json.Marshal(sizes); jsonErr == nil {
+				md[exporterPartSizesKey] = string(sizesJSON)
+			}
+			md[exporterPartsCompleteKey] = "false"
+			return md, emitSummary(err)
+		}
+		sizesJSON, err := json.Marshal(sizes)
+		if err != nil {
+			return nil, emitSummary(err)
+		}
+		md[exporterPartsKey] = strconv.Itoa(len(sizes))
+		md[exporterPartSizesKey] = string(sizesJSON)
+		md[exporterPartsCompleteKey] = "true"
+		return md, emitSummary(nil)
+	}
+
+	w, err := copyFileWriter(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	w = e.bufferWriter(w)
+	if len(e.fanoutSessions) > 0 {
+		// the fan-out sits below progress, digest and compression so
+		// every session receives the identical final byte stream
+		if w, err = e.newFanoutWriter(ctx, sessionID, w); err != nil {
+			return nil, emitSummary(err)
+		}
+	}
+	pw := newProgressWriter(w, local.NewProgressHandler(ctx, "transferring tarball", e.progressOpt("", sizeEstimate)))
+	w = pw
+	var dw *digestWriter
+	if e.computeDigest {
+		dw = newDigestWriter(w)
+		w = dw
+	}
+	wc, err := e.compressionWriter(w)
+	if err != nil {
+		pw.finish()
+		return nil, emitSummary(err)
+	}
+
+	ucw := &countingWriter{w: wc}
+	var tarW io.Writer = ucw
+	var tv *tarVerifier
+	if e.verify {
+		tv = newTarVerifier()
+		tarW = io.MultiWriter(ucw, tv)
+	}
+	nfiles, err := writeTarCount(ctx, fs, tarW, twOpts)
+	summary.Files = int64(nfiles)
+	summary.BytesUncompressed = ucw.n
+	summary.BytesWritten = int64(pw.n)
+	if tv != nil {
+		n, verr := tv.finish(err)
+		summary.VerifiedEntries = n
+		if err == nil {
+			err = verr
+		}
+	}
+	if err != nil {
+		wc.Close()
+		pw.finish()
+		return nil, emitSummary(err)
+	}
+	if err := wc.Close(); err != nil {
+		pw.finish()
+		return nil, emitSummary(err)
+	}
+	pw.finish()
+	summary.BytesWritten = int64(pw.n)
+	if separateAttestations {
+		if err := e.writeAttestationsTar(ctx, caller, attFS, twOpts); err != nil {
+			return nil, emitSummary(err)
+		}
+		md[exporterAttestationsKey] = attestationsOutputSeparate
+	}
+	if dw != nil {
+		md[exporterDigestKey] = dw.Digest().String()
+		md[exporterSizeKey] = strconv.FormatInt(dw.n, 10)
+	}
+	return md, emitSummary(nil)
 }
 
-type localExporter struct {
-	opt Opt
-	// session manager
+// formatEpoch returns the epoch for one output format: the per-format
+// override when set, the global epoch otherwise.
+func (e *localExporterInstance) formatEpoch(f string) *time.Time {
+	if tm, ok := e.formatEpochs[f]; ok {
+		return tm
+	}
+	return e.opts.Epoch
 }
 
-func New(opt Opt) (exporter.Exporter, error) {
-	le := &localExporter{opt: opt}
-	return le, nil
+// suggestedFilename builds the advisory download name reported in the
+// export metadata: a "build" stem, the date and the exported platform
+// set, with the extension matching the configured compression. The date
+// comes from the pinned epoch when one is set, so reproducible builds get
+// a stable name; otherwise it is the export time.
+func (e *localExporterInstance) suggestedFilename(platforms []exptypes.Platform) string {
+	t := e.now()
+	if e.opts.Epoch != nil {
+		t = *e.opts.Epoch
+	}
+	parts := []string{"build", t.UTC().Format("2006-01-02")}
+	for _, p := range platforms {
+		if p.ID == "" {
+			continue
+		}
+		parts = append(parts, sanitizeFilenameComponent(p.ID))
+	}
+	name := strings.Join(parts, "-") + ".tar"
+	switch e.compression {
+	case "gzip":
+		name += ".gz"
+	case "zstd":
+		name += ".zst"
+	case "lz4":
+		name += ".lz4"
+	}
+	return name
 }
 
-func (e *localExporter) Resolve(ctx context.Context, opt map[string]string) (exporter.ExporterInstance, error) {
-	li := &localExporterInstance{localExporter: e}
+// sanitizeFilenameComponent replaces characters that are unsafe in a
+// filename (notably the slash in platform IDs) with underscores.
+func sanitizeFilenameComponent(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
 
-	tm, opt, err := epoch.ParseExporterAttrs(opt)
+// emitExportSummary writes the final ExportSummary progress value for the
+// export. Exactly one summary is emitted per tarball export, on the failure
+// path too with the error noted, so embedders subscribed to the progress
+// stream can collect metrics without scraping status strings.
+func (e *localExporterInstance) emitExportSummary(ctx context.Context, start time.Time, s *progress.ExportSummary, err error) {
+	s.Duration = time.Since(start)
 	if err != nil {
-		return nil, err
+		s.Error = err.Error()
 	}
-	li.opts.Epoch = tm
+	if e.compression != "" && s.BytesUncompressed > 0 && s.BytesWritten > 0 {
+		s.CompressionRatio = float64(s.BytesWritten) / float64(s.BytesUncompressed)
+	}
+	pw, _, _ := progress.NewFromContext(ctx)
+	pw.Write("exporting tarball#summary", *s)
+	pw.Close()
+}
 
-	multiPlatform, opt, err := multiplatform.ParseExporterAttrs(opt)
+// uploadTar streams the tarball with an HTTP PUT to the configured
+// output-url instead of sending it over the client session. The request
+// body is produced through a pipe so the upload is streamed without
+// buffering the whole archive; cancelling ctx aborts the request.
+func (e *localExporterInstance) uploadTar(ctx context.Context, fs fsutil.FS) error {
+	u, err := url.Parse(e.outputURL)
 	if err != nil {
-		return nil, err
+		return errors.Wrapf(err, "invalid value for %s: %s", outputURLKey, e.outputURL)
+	}
+	var user *url.Userinfo
+	if u.User != nil {
+		user = u.User
+		u.User = nil
 	}
-	li.opts.MultiPlatform = multiPlatform
 
-	for k, v := range opt {
-		switch k {
-		case preferNondistLayersKey:
-			b, err := strconv.ParseBool(v)
-			if err != nil {
-				return nil, errors.Wrapf(err, "non-bool value for %s: %s", preferNondistLayersKey, v)
-			}
-			li.preferNonDist = b
-		case attestationPrefixKey:
-			li.opts.AttestationPrefix = v
-		}
+	report := progress.OneOff(ctx, "uploading tarball to "+u.Redacted())
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), pr)
+	if err != nil {
+		return report(err)
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	for k, v := range e.outputHeaders {
+		req.Header.Set(k, v)
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
 	}
 
-	return li, nil
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			errCh <- errors.Wrapf(err, "failed to upload tarball to %s", u.Redacted())
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			dt, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			err := errors.Errorf("invalid response status %s from %s: %s", resp.Status, u.Redacted(), strings.TrimSpace(string(dt)))
+			pr.CloseWithError(err)
+			errCh <- err
+			return
+		}
+		errCh <- nil
+	}()
+
+	wc, err := e.compressionWriter(pw)
+	if err != nil {
+		pw.CloseWithError(err)
+		<-errCh
+		return report(err)
+	}
+	if err := writeTar(ctx, fs, wc, e.writeTarOpts()); err != nil {
+		wc.Close()
+		pw.CloseWithError(err)
+		<-errCh
+		return report(err)
+	}
+	if err := wc.Close(); err != nil {
+		pw.CloseWithError(err)
+		<-errCh
+		return report(err)
+	}
+	if err := pw.Close(); err != nil {
+		<-errCh
+		return report(err)
+	}
+	return report(<-errCh)
 }
 
-type localExporterInstance struct {
-	*localExporter
-	opts          local.CreateFSOpts
-	preferNonDist bool
+// writeAttestationsTar sends the attestations-only filesystem as a second
+// tar stream after the main tarball.
+func (e *localExporterInstance) writeAttestationsTar(ctx context.Context, caller session.Caller, fs fsutil.FS, twOpts writeTarOpts) error {
+	if fs == nil {
+		fs = staticfs.NewFS()
+	}
+	w, err := filesync.CopyFileWriter(ctx, nil, caller)
+	if err != nil {
+		return err
+	}
+	wc, err := e.compressionWriter(e.bufferWriter(w))
+	if err != nil {
+		return err
+	}
+	if err := writeTar(ctx, fs, wc, twOpts); err != nil {
+		wc.Close()
+		return errors.Wrap(err, "failed to write attestations tar")
+	}
+	return wc.Close()
 }
 
-func (e *localExporterInstance) Name() string {
-	return "exporting to client tarball"
+// pickPlatform selects the platform exported by a flat (non-map) export:
+// the one matching the default-platform option when set, otherwise the
+// first entry, which keeps selection deterministic across refactors of the
+// platforms list handling.
+func (e *localExporterInstance) pickPlatform(in []exptypes.Platform) (exptypes.Platform, error) {
+	if e.defaultPlatform == "" {
+		return in[0], nil
+	}
+	var matcher platforms.Matcher
+	if pl, err := platforms.Parse(e.defaultPlatform); err == nil {
+		matcher = platforms.OnlyStrict(pl)
+	}
+	available := make([]string, 0, len(in))
+	for _, pp := range in {
+		if pp.ID == e.defaultPlatform || (matcher != nil && matcher.Match(pp.Platform)) {
+			return pp, nil
+		}
+		available = append(available, pp.ID)
+	}
+	return exptypes.Platform{}, errors.Errorf("%s %s does not match any exported platform (available: %s)", defaultPlatformKey, e.defaultPlatform, strings.Join(available, ", "))
 }
 
-func (e *localExporterInstance) Config() *exporter.Config {
-	return exporter.NewConfig()
+// wantsFormat reports whether f was requested via the formats option.
+func (e *localExporterInstance) wantsFormat(f string) bool {
+	for _, ff := range e.outputFormats {
+		if ff == f {
+			return true
+		}
+	}
+	return false
 }
 
-func (e *localExporterInstance) Export(ctx context.Context, inp *exporter.Source, sessionID string) (map[string]string, error) {
-	var defers []func() error
+// exportFormats produces one artifact per requested format from the same
+// solve, each over its own file writer, so CI can get e.g. a rootfs
+// tarball and an OCI layout without re-solving. Failures close the
+// in-flight writer chain before returning, so the client side is never
+// left waiting on an orphaned stream, and per-format digests are reported
+// under the format.digests metadata key.
+func (e *localExporterInstance) exportFormats(ctx context.Context, caller session.Caller, fs fsutil.FS, layoutFSs []fsutil.FS, platforms []exptypes.Platform, now time.Time) (map[string]string, error) {
+	twOpts := e.writeTarOpts()
+	digests := make(map[string]string, len(e.outputFormats))
 
-	defer func() {
-		for i := len(defers) - 1; i >= 0; i-- {
-			defers[i]()
+	for _, f := range e.outputFormats {
+		outFS := fs
+		if f == formatOCI {
+			lfs := layoutFSs
+			if lfs == nil {
+				lfs = []fsutil.FS{fs}
+			}
+			var err error
+			outFS, err = ociLayoutFS(ctx, platforms, lfs, e.formatEpoch(formatOCI), now, twOpts, e.annotations, e.indexAnnotations)
+			if err != nil {
+				return nil, err
+			}
 		}
-	}()
 
-	if e.opts.Epoch == nil {
-		if tm, ok, err := epoch.ParseSource(inp); err != nil {
+		report := progress.OneOff(ctx, "sending "+f+" artifact")
+		w, err := copyFileWriter(ctx, caller)
+		if err != nil {
+			return nil, report(err)
+		}
+		pw := newProgressWriter(e.bufferWriter(w), local.NewProgressHandler(ctx, "transferring "+f+" artifact", e.progressOpt("", 0)))
+		dw := newDigestWriter(pw)
+		wc, err := e.compressionWriter(dw)
+		if err != nil {
+			pw.finish()
+			return nil, report(err)
+		}
+		if err := writeTar(ctx, outFS, wc, twOpts); err != nil {
+			wc.Close()
+			pw.finish()
+			return nil, report(err)
+		}
+		if err := wc.Close(); err != nil {
+			pw.finish()
+			return nil, report(err)
+		}
+		pw.finish()
+		digests[f] = dw.Digest().String()
+		if err := report(nil); err != nil {
 			return nil, err
-		} else if ok {
-			e.opts.Epoch = tm
 		}
 	}
 
-	now := time.Now().Truncate(time.Second)
+	md := map[string]string{}
+	if err := e.addOptionsMetadata(md); err != nil {
+		return nil, err
+	}
+	if e.stripSpecialBits {
+		md[exporterSpecialBitsStrippedKey] = "true"
+	}
+	dt, err := json.Marshal(digests)
+	if err != nil {
+		return nil, err
+	}
+	md[exporterFormatDigestsKey] = string(dt)
+	return md, nil
+}
+
+// exportStream writes a multi-platform export one platform at a time,
+// mounting, writing and releasing each platform's filesystem in turn
+// instead of assembling a combined SubDirFS up front. This keeps at most
+// one ref mounted at a time for very large exports.
+func (e *localExporterInstance) exportStream(ctx context.Context, inp *exporter.Source, sessionID string, platforms []exptypes.Platform, now time.Time, start time.Time) (map[string]string, error) {
+	caller, err := e.getCaller(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := copyFileWriter(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	w = e.bufferWriter(w)
+	report := progress.OneOff(ctx, e.progressLabel())
+
+	pw := newProgressWriter(w, local.NewProgressHandler(ctx, "transferring tarball", e.progressOpt("", estimateSize(ctx, inp))))
+	w = pw
+	var dw *digestWriter
+	if e.computeDigest {
+		dw = newDigestWriter(w)
+		w = dw
+	}
+	wc, err := e.compressionWriter(w)
+	if err != nil {
+		pw.finish()
+		return nil, report(err)
+	}
+
+	summary := &progress.ExportSummary{}
+	emitSummary := func(err error) error {
+		e.emitExportSummary(ctx, start, summary, err)
+		return report(err)
+	}
+
+	fail := func(err error) (map[string]string, error) {
+		wc.Close()
+		pw.finish()
+		return nil, emitSummary(err)
+	}
+
+	mtime := now
+	if e.opts.Epoch != nil {
+		mtime = *e.opts.Epoch
+	}
+
+	twOpts := e.writeTarOpts()
+	cw := &countingWriter{w: wc}
+	var tarDst io.Writer = cw
+	var tracker *platformProgressWriter
+	if e.perPlatformProgress {
+		tracker = &platformProgressWriter{w: cw}
+		tarDst = tracker
+	}
+	tw := tar.NewWriter(tarDst)
+
+	prefix := ""
+	if e.pathPrefix != "" {
+		for _, seg := range strings.Split(e.pathPrefix, "/") {
+			if err := writeTarDirHeader(tw, prefix+seg, mtime, e.tarFormat); err != nil {
+				return fail(err)
+			}
+			prefix += seg + "/"
+		}
+	}
 
-	getDir := func(ctx context.Context, k string, ref cache.ImmutableRef, attestations []result.Attestation) (*fsutil.Dir, error) {
-		outputFS, cleanup, err := local.CreateFS(ctx, sessionID, k, ref, inp.Refs, attestations, now, e.opts)
+	platformSizes := make(map[string]int64, len(platforms))
+	for _, pp := range platforms {
+		r, ok := inp.Refs[pp.ID]
+		if !ok {
+			return fail(errors.Errorf("failed to find ref for ID %s", pp.ID))
+		}
+		outputFS, cleanup, err := local.CreateFS(ctx, sessionID, pp.ID, r, inp.Refs, inp.Attestations[pp.ID], now, e.opts)
 		if err != nil {
-			return nil, err
+			return fail(err)
 		}
+		partStart := cw.n
+		dirName := prefix + e.platformDirName(pp.ID)
+		if tracker != nil {
+			tracker.begin(local.NewProgressHandler(ctx, "transferring "+pp.ID, e.progressOpt(pp.ID, 0)))
+		}
+		if err := writeTarDirHeader(tw, dirName, mtime, e.tarFormat); err != nil {
+			if cleanup != nil {
+				cleanup()
+			}
+			if tracker != nil {
+				tracker.finish()
+			}
+			return fail(err)
+		}
+		nentries, err := writeTarEntriesCount(ctx, outputFS, tw, tarDst, dirName+"/", twOpts)
+		if err == nil {
+			// flush the padding of the last entry so the byte count is
+			// attributed to this platform and not the next one
+			err = tw.Flush()
+		}
+		// release this platform's mounts before moving to the next one
 		if cleanup != nil {
-			defers = append(defers, cleanup)
+			cleanup()
 		}
-
-		st := fstypes.Stat{
-			Mode: uint32(os.ModeDir | 0755),
-			Path: strings.Replace(k, "/", "_", -1),
+		if tracker != nil {
+			tracker.finish()
 		}
-		if e.opts.Epoch != nil {
-			st.ModTime = e.opts.Epoch.UnixNano()
+		if err != nil {
+			return fail(err)
 		}
+		platformSizes[pp.ID] = cw.n - partStart
+		summary.Files += int64(nentries) + 1 // +1 for the platform dir entry
+	}
 
-		return &fsutil.Dir{
-			FS:   outputFS,
-			Stat: st,
-		}, nil
+	if err := tw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := wc.Close(); err != nil {
+		pw.finish()
+		return nil, emitSummary(err)
 	}
+	pw.finish()
+	summary.BytesUncompressed = cw.n
+	summary.BytesWritten = int64(pw.n)
+	summary.PlatformBytes = platformSizes
 
-	isMap := len(inp.Refs) > 0
+	md := map[string]string{}
+	if err := e.addOptionsMetadata(md); err != nil {
+		return nil, emitSummary(err)
+	}
+	if e.stripSpecialBits {
+		md[exporterSpecialBitsStrippedKey] = "true"
+	}
+	if len(platformSizes) > 0 {
+		dt, err := json.Marshal(platformSizes)
+		if err != nil {
+			return nil, emitSummary(err)
+		}
+		md[exporterPlatformSizesKey] = string(dt)
+	}
+	if dw != nil {
+		md[exporterDigestKey] = dw.Digest().String()
+		md[exporterSizeKey] = strconv.FormatInt(dw.n, 10)
+	}
+	return md, emitSummary(nil)
+}
 
-	platformsBytes, ok := inp.Metadata[exptypes.ExporterPlatformsKey]
-	if len(inp.Refs) > 0 && !ok {
-		return nil, errors.Errorf("unable to export multiple refs, missing platforms mapping")
+// progressOpt builds the progress handler options from the instance
+// configuration, applying the configured update rate.
+func (e *localExporterInstance) progressOpt(platform string, total int64) local.ProgressHandlerOpt {
+	return local.ProgressHandlerOpt{
+		Platform: platform,
+		Total:    total,
+		Interval: e.progressInterval,
 	}
+}
 
-	var p exptypes.Platforms
-	if ok && len(platformsBytes) > 0 {
-		if err := json.Unmarshal(platformsBytes, &p); err != nil {
-			return nil, errors.Wrapf(err, "failed to parse platforms passed to exporter")
-		}
-		if len(p.Platforms) > 1 {
-			isMap = true
-		}
+// copyFileWriter opens the tar byte stream to the client. A same-host
+// client can attach an FD sink, in which case the bytes go straight into
+// its named pipe with no filesync framing; otherwise the resumable stream
+// variant is preferred when attached so an interrupted transfer can
+// continue without resending received bytes.
+func copyFileWriter(ctx context.Context, caller session.Caller) (io.WriteCloser, error) {
+	if filesync.SupportsFDSink(caller) {
+		return filesync.CopyFileFD(ctx, caller)
 	}
+	if filesync.SupportsResume(caller) {
+		w, _, err := filesync.CopyFileWriterResumable(ctx, nil, caller)
+		return w, err
+	}
+	// progress is reported through the exporter's own progressWriter, so
+	// no filesync-level callback is needed here
+	return filesync.CopyFileWriterWithProgress(ctx, nil, caller, nil)
+}
 
-	if e.opts.MultiPlatform != nil {
-		isMap = *e.opts.MultiPlatform
+// nestPlatformDirs builds a SubDirFS preserving slash-separated directory
+// names as real nested directories, e.g. a dir named linux/amd64 becomes
+// an amd64 dir inside a synthetic linux dir. The synthetic intermediate
+// directories take their mtime from the epoch when one is set, falling
+// back to the export time. SubDirFS itself rejects colliding names.
+func nestPlatformDirs(dirs []fsutil.Dir, now time.Time, tm *time.Time) (fsutil.FS, error) {
+	var top []fsutil.Dir
+	var order []string
+	groups := map[string][]fsutil.Dir{}
+	for _, d := range dirs {
+		name, rest, ok := strings.Cut(d.Stat.Path, "/")
+		if !ok {
+			top = append(top, d)
+			continue
+		}
+		if _, ok := groups[name]; !ok {
+			order = append(order, name)
+		}
+		d.Stat.Path = rest
+		groups[name] = append(groups[name], d)
 	}
-	if !isMap && len(p.Platforms) > 1 {
-		return nil, errors.Errorf("unable to export multiple platforms without map")
+	for _, name := range order {
+		sub, err := nestPlatformDirs(groups[name], now, tm)
+		if err != nil {
+			return nil, err
+		}
+		st := fstypes.Stat{
+			Mode:    uint32(os.ModeDir | 0755),
+			Path:    name,
+			ModTime: now.UnixNano(),
+		}
+		if tm != nil {
+			st.ModTime = tm.UnixNano()
+		}
+		top = append(top, fsutil.Dir{FS: statCopyFS{sub}, Stat: st})
 	}
+	return fsutil.SubDirFS(top)
+}
 
-	var fs fsutil.FS
+// statCopyFS hands out a copy of each entry's Stat during Walk. SubDirFS
+// rewrites the stats it receives in place, so nesting one SubDirFS inside
+// another without this would rename the inner synthetic directories
+// mid-walk through the shared pointers.
+type statCopyFS struct {
+	fsutil.FS
+}
 
-	if len(inp.Refs) > 0 {
-		dirs := make([]fsutil.Dir, 0, len(p.Platforms))
-		for _, p := range p.Platforms {
-			r, ok := inp.Refs[p.ID]
-			if !ok {
-				return nil, errors.Errorf("failed to find ref for ID %s", p.ID)
-			}
-			d, err := getDir(ctx, p.ID, r, inp.Attestations[p.ID])
-			if err != nil {
-				return nil, err
+func (fs statCopyFS) Walk(ctx context.Context, fn filepath.WalkFunc) error {
+	return fs.FS.Walk(ctx, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi != nil {
+			if st, ok := fi.Sys().(*fstypes.Stat); ok {
+				c := *st
+				fi = &fsutil.StatInfo{Stat: &c}
 			}
-			if !isMap {
-				fs = d.FS
-				break
-			}
-			dirs = append(dirs, *d)
 		}
-		if isMap {
-			var err error
-			fs, err = fsutil.SubDirFS(dirs)
-			if err != nil {
-				return nil, err
-			}
+		return fn(p, fi, err)
+	})
+}
+
+// dryRunMetadata walks the assembled filesystem without transferring it
+// and reports what an actual export would contain.
+func dryRunMetadata(ctx context.Context, fs fsutil.FS, platforms []exptypes.Platform) (map[string]string, error) {
+	var entries int64
+	var size int64
+	err := fs.Walk(ctx, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-	} else {
-		d, err := getDir(ctx, "", inp.Ref, nil)
+		entries++
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to walk filesystem for dry-run")
+	}
+
+	md := map[string]string{
+		exporterDryRunKey:        "true",
+		exporterDryRunEntriesKey: strconv.FormatInt(entries, 10),
+		exporterDryRunSizeKey:    strconv.FormatInt(size, 10),
+	}
+	if len(platforms) > 0 {
+		ids := make([]string, len(platforms))
+		for i, p := range platforms {
+			ids[i] = p.ID
+		}
+		idsJSON, err := json.Marshal(ids)
 		if err != nil {
 			return nil, err
 		}
-		fs = d.FS
+		md[exporterDryRunPlatformsKey] = string(idsJSON)
 	}
+	return md, nil
+}
 
-	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+// validateAnnotation checks an annotation option parsed from its
+// annotation. or annotation-index. prefixed key.
+func validateAnnotation(name, v string) error {
+	if name == "" {
+		return errors.Errorf("empty annotation key")
+	}
+	if !utf8.ValidString(v) {
+		return errors.Errorf("annotation %s value is not valid UTF-8", name)
+	}
+	return nil
+}
 
-	caller, err := e.opt.SessionManager.Get(timeoutCtx, sessionID, false)
-	if err != nil {
-		return nil, err
+// isEmptySource reports whether the build produced no output at all:
+// neither a single ref nor any entry in the refs map.
+func isEmptySource(inp *exporter.Source) bool {
+	return inp.Ref == nil && len(inp.Refs) == 0
+}
+
+// estimateSize sums the snapshot sizes of the exported refs to give clients
+// an expected uncompressed byte total up front. The number is only an
+// estimate: snapshot usage counts allocated blocks, so symlinks, hardlinks
+// and sparse files can skew it in either direction. Refs whose size cannot
+// be determined are skipped rather than failing the export.
+func estimateSize(ctx context.Context, inp *exporter.Source) int64 {
+	var total int64
+	add := func(ref cache.ImmutableRef) {
+		if ref == nil {
+			return
+		}
+		if s, err := ref.Size(ctx); err == nil && s > 0 {
+			total += s
+		}
+	}
+	if len(inp.Refs) > 0 {
+		for _, ref := range inp.Refs {
+			add(ref)
+		}
+	} else {
+		add(inp.Ref)
 	}
+	return total
+}
 
-	w, err := filesync.CopyFileWriter(ctx, nil, caller)
-	if err != nil {
-		return nil, err
+// progressWriter counts the bytes written to the client and reports them
+// through a rate-limited progress handler so large exports show transfer
+// progress instead of a bare spinner. finish marks the transfer complete
+// and must be called on both success and error paths.
+type progressWriter struct {
+	io.WriteCloser
+	fn   func(int, bool)
+	n    int
+	done bool
+}
+
+func newProgressWriter(w io.WriteCloser, fn func(int, bool)) *progressWriter {
+	return &progressWriter{WriteCloser: w, fn: fn}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.n += n
+		w.fn(w.n, false)
 	}
-	report := progress.OneOff(ctx, "sending tarball")
-	if err := fsutil.WriteTar(ctx, fs, w); err != nil {
-		w.Close()
-		return nil, report(err)
+	return n, err
+}
+
+func (w *progressWriter) finish() {
+	if !w.done {
+		w.done = true
+		w.fn(w.n, true)
+	}
+}
+
+// platformProgressWriter attributes the tar bytes of the streaming write
+// path to the platform currently being written, feeding the per-platform
+// child status between begin and finish. The streaming path writes
+// platforms sequentially on one goroutine, so no locking is needed. See
+// the per-platform-progress option.
+type platformProgressWriter struct {
+	w  io.Writer
+	fn func(int, bool)
+	n  int
+}
+
+func (w *platformProgressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.n += n
+		if w.fn != nil {
+			w.fn(w.n, false)
+		}
+	}
+	return n, err
+}
+
+// begin starts attributing subsequent bytes to a new platform.
+func (w *platformProgressWriter) begin(fn func(int, bool)) {
+	w.fn = fn
+	w.n = 0
+}
+
+// finish delivers the final update for the current platform and stops
+// attributing bytes until the next begin.
+func (w *platformProgressWriter) finish() {
+	if w.fn != nil {
+		w.fn(w.n, true)
+		w.fn = nil
+	}
+}
+
+// digestWriter tees writes into a SHA256 digester and counts the bytes
+// passing through, so the exporter can report the tarball's content digest
+// and size without buffering it.
+type digestWriter struct {
+	io.WriteCloser
+	digester digest.Digester
+	n        int64
+}
+
+func newDigestWriter(w io.WriteCloser) *digestWriter {
+	return &digestWriter{WriteCloser: w, digester: digest.Canonical.Digester()}
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.digester.Hash().Write(p[:n])
+		w.n += int64(n)
 	}
-	return nil, report(w.Close())
+	return n, err
+}
+
+func (w *digestWriter) Digest() digest.Digest {
+	return w.digester.Digest()
 }
@@ -0,0 +1,195 @@
+package local
+
+import (
+	"context"
+	"io"
+
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// fanoutChunkSize and fanoutChunkCount bound how far a fan-out
+	// consumer may fall behind the primary stream: each consumer queues
+	// at most fanoutChunkCount chunks of at most fanoutChunkSize bytes
+	// (a ~1MiB window) before the fan-out policy applies.
+	fanoutChunkSize  = 32 * 1024
+	fanoutChunkCount = 32
+)
+
+// fanoutWriter duplicates one tar stream to additional client sessions.
+// The primary writer is written synchronously and its errors always fail
+// the export; every extra consumer drains a bounded queue in its own
+// goroutine so a slow client cannot stall the others beyond the queued
+// window. What happens when a consumer errors or falls behind is decided
+// by the fanout-policy option: drop disconnects it and continues for the
+// rest, error (the default) fails the whole export.
+type fanoutWriter struct {
+	ctx       context.Context
+	primary   io.WriteCloser
+	consumers []*fanoutConsumer
+	policy    string
+}
+
+// fanoutConsumer feeds one extra session. The producer stops feeding when
+// failed is closed; finished is closed when the drain goroutine exits.
+// err is published by the goroutine before closing either channel, and
+// dropped is only touched by the producer, so neither needs a lock.
+type fanoutConsumer struct {
+	id       string
+	ch       chan []byte
+	failed   chan struct{}
+	finished chan struct{}
+	err      error
+	dropped  bool
+}
+
+// run drains the consumer's queue into its session writer. After a write
+// error the queue keeps draining so the producer never blocks on a failed
+// consumer.
+func (c *fanoutConsumer) run(w io.WriteCloser) {
+	defer close(c.finished)
+	for buf := range c.ch {
+		if c.err != nil {
+			continue
+		}
+		if _, err := w.Write(buf); err != nil {
+			c.err = err
+			close(c.failed)
+		}
+	}
+	if err := w.Close(); err != nil && c.err == nil {
+		c.err = err
+		close(c.failed)
+	}
+}
+
+// newFanoutWriter opens a tar stream writer to every fanout session and
+// returns a writer duplicating primary's stream to all of them. Sessions
+// that cannot be reached follow the fan-out policy like any other
+// consumer failure.
+func (e *localExporterInstance) newFanoutWriter(ctx context.Context, primarySessionID string, primary io.WriteCloser) (io.WriteCloser, error) {
+	f := &fanoutWriter{ctx: ctx, primary: primary, policy: e.fanoutPolicy}
+	seen := map[string]struct{}{primarySessionID: {}}
+	for _, id := range e.fanoutSessions {
+		if _, ok := seen[id]; ok {
+			// the primary session already receives the stream, and
+			// repeated ids only need one copy
+			continue
+		}
+		seen[id] = struct{}{}
+		caller, err := e.getCaller(ctx, id)
+		var w io.WriteCloser
+		if err == nil {
+			w, err = copyFileWriter(ctx, caller)
+			if err == nil {
+				w = e.bufferWriter(w)
+			}
+		}
+		if err != nil {
+			if e.fanoutPolicy == fanoutPolicyDrop {
+				bklog.G(ctx).Warnf("dropping fan-out session %s: %v", id, err)
+				continue
+			}
+			f.closeConsumers()
+			return nil, errors.Wrapf(err, "failed to open fan-out stream to session %s", id)
+		}
+		c := &fanoutConsumer{
+			id:       id,
+			ch:       make(chan []byte, fanoutChunkCount),
+			failed:   make(chan struct{}),
+			finished: make(chan struct{}),
+		}
+		f.consumers = append(f.consumers, c)
+		go c.run(w)
+	}
+	if len(f.consumers) == 0 {
+		return primary, nil
+	}
+	return f, nil
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += fanoutChunkSize {
+		end := off + fanoutChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		chunk := p[off:end]
+		// the caller may reuse p after Write returns, so consumers get a
+		// copy; one buffer is shared read-only by all of them
+		buf := make([]byte, len(chunk))
+		copy(buf, chunk)
+		for _, c := range f.consumers {
+			if c.dropped {
+				continue
+			}
+			if err := f.feed(c, buf); err != nil {
+				return off, err
+			}
+		}
+		if _, err := f.primary.Write(chunk); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+// feed queues one chunk for a consumer. With the drop policy a full queue
+// or a failed consumer disconnects it immediately; with the error policy
+// the producer blocks until there is room, so the bounded buffer only
+// smooths jitter and a consumer failure aborts the export.
+func (f *fanoutWriter) feed(c *fanoutConsumer, buf []byte) error {
+	if f.policy == fanoutPolicyDrop {
+		select {
+		case c.ch <- buf:
+			return nil
+		case <-c.failed:
+		default:
+		}
+		f.drop(c)
+		return nil
+	}
+	select {
+	case c.ch <- buf:
+		return nil
+	case <-c.failed:
+		return errors.Wrapf(c.err, "failed to fan out to session %s", c.id)
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	}
+}
+
+func (f *fanoutWriter) drop(c *fanoutConsumer) {
+	c.dropped = true
+	close(c.ch)
+	bklog.G(f.ctx).Warnf("dropping fan-out session %s: consumer failed or cannot keep up", c.id)
+}
+
+func (f *fanoutWriter) Close() error {
+	err := f.primary.Close()
+	for _, c := range f.consumers {
+		if !c.dropped {
+			close(c.ch)
+		}
+		<-c.finished
+		if c.err == nil || c.dropped {
+			continue
+		}
+		if f.policy == fanoutPolicyDrop {
+			bklog.G(f.ctx).Warnf("fan-out session %s failed: %v", c.id, c.err)
+		} else if err == nil {
+			err = errors.Wrapf(c.err, "failed to fan out to session %s", c.id)
+		}
+	}
+	return err
+}
+
+// closeConsumers shuts down the consumers opened so far when the fan-out
+// setup itself fails partway.
+func (f *fanoutWriter) closeConsumers() {
+	for _, c := range f.consumers {
+		close(c.ch)
+		<-c.finished
+	}
+}
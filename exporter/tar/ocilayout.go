@@ -0,0 +1,133 @@
+package local
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/util/staticfs"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// ociLayoutFS assembles an OCI image layout (oci-layout, index.json,
+// blobs/sha256/...) of the exported filesystems. Each platform becomes a
+// single-layer manifest whose layer blob is the gzipped tar of that
+// platform's rootfs, and the index carries one entry per platform. Layer
+// descriptors and the index carry the configured annotations. File
+// mtimes and the image created timestamps honor the export epoch when one
+// is set, falling back to the export time.
+func ociLayoutFS(ctx context.Context, platforms []exptypes.Platform, fss []fsutil.FS, epoch *time.Time, now time.Time, twOpts writeTarOpts, layerAnnotations, indexAnnotations map[string]string) (fsutil.FS, error) {
+	created := now
+	if epoch != nil {
+		created = *epoch
+	}
+
+	out := staticfs.NewFS()
+	add := func(p string, dt []byte) {
+		out.Add(p, fstypes.Stat{Mode: 0644, ModTime: created.UnixNano()}, dt)
+	}
+	addBlob := func(dt []byte) digest.Digest {
+		dgst := digest.FromBytes(dt)
+		add(path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded()), dt)
+		return dgst
+	}
+
+	manifests := make([]ocispecs.Descriptor, 0, len(fss))
+	for i, fs := range fss {
+		var tarBuf bytes.Buffer
+		if err := writeTar(ctx, fs, &tarBuf, twOpts); err != nil {
+			return nil, errors.Wrap(err, "failed to write layer tar for OCI layout")
+		}
+		diffID := digest.FromBytes(tarBuf.Bytes())
+
+		var gzBuf bytes.Buffer
+		gz := gzip.NewWriter(&gzBuf)
+		if _, err := gz.Write(tarBuf.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		layerDgst := addBlob(gzBuf.Bytes())
+
+		var pl *ocispecs.Platform
+		if i < len(platforms) {
+			p := platforms[i].Platform
+			pl = &p
+		}
+
+		img := ocispecs.Image{
+			Created: &created,
+			RootFS: ocispecs.RootFS{
+				Type:    "layers",
+				DiffIDs: []digest.Digest{diffID},
+			},
+		}
+		if pl != nil {
+			img.Architecture = pl.Architecture
+			img.OS = pl.OS
+		}
+		configDt, err := json.Marshal(img)
+		if err != nil {
+			return nil, err
+		}
+		configDgst := addBlob(configDt)
+
+		mfst := ocispecs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Config: ocispecs.Descriptor{
+				MediaType: ocispecs.MediaTypeImageConfig,
+				Digest:    configDgst,
+				Size:      int64(len(configDt)),
+			},
+			Layers: []ocispecs.Descriptor{{
+				MediaType:   ocispecs.MediaTypeImageLayerGzip,
+				Digest:      layerDgst,
+				Size:        int64(gzBuf.Len()),
+				Annotations: layerAnnotations,
+			}},
+		}
+		mfstDt, err := json.Marshal(mfst)
+		if err != nil {
+			return nil, err
+		}
+		mfstDgst := addBlob(mfstDt)
+
+		manifests = append(manifests, ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Digest:    mfstDgst,
+			Size:      int64(len(mfstDt)),
+			Platform:  pl,
+		})
+	}
+
+	index := ocispecs.Index{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispecs.MediaTypeImageIndex,
+		Manifests:   manifests,
+		Annotations: indexAnnotations,
+	}
+	indexDt, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	add("index.json", indexDt)
+
+	layoutDt, err := json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+	if err != nil {
+		return nil, err
+	}
+	add(ocispecs.ImageLayoutFile, layoutDt)
+
+	return out, nil
+}
@@ -0,0 +1,1047 @@
+package local
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/moby/buildkit/exporter/util/epoch"
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/moby/patternmatcher"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// writeTarOpts controls how writeTar serializes the filesystem into a tar
+// stream. The zero value matches the behavior of fsutil.WriteTar.
+type writeTarOpts struct {
+	// deterministic sorts all entries lexicographically and normalizes
+	// non-reproducible header fields so two runs over the same inputs
+	// produce byte-identical output.
+	deterministic bool
+	// strictDeterministic additionally rejects inputs that normalization
+	// cannot make reproducible: sub-second mtimes without a pinned epoch,
+	// duplicate entry paths and special files. See deterministic=strict.
+	// epochPinned records that a source date epoch rewrote mtimes, which
+	// makes sub-second input mtimes a non-issue.
+	strictDeterministic bool
+	epochPinned         bool
+	// format forces a specific tar header format for all entries. The zero
+	// value lets archive/tar pick a format per entry.
+	format tar.Format
+	// preserveXattrs writes extended attributes from the source filesystem
+	// as SCHILY.xattr PAX records. Requires the PAX format.
+	preserveXattrs bool
+	// preserveCaps writes the security.capability attribute alone, for
+	// exports that need working setcap binaries without carrying every
+	// other xattr. Implied by preserveXattrs.
+	preserveCaps bool
+	// stripSpecialBits clears setuid, setgid and sticky bits from all
+	// entry modes.
+	stripSpecialBits bool
+	// chmodRules override the permission bits of matching entries, last
+	// match winning.
+	chmodRules []chmodRule
+	// textEOL normalizes the line endings of matching text files to "lf"
+	// or "crlf" as they are written. textEOLMatcher narrows which files
+	// are candidates; nil means every regular file. Files with a null
+	// byte in their leading textSniffLen bytes are treated as binary and
+	// left alone. Normalization rewrites content, so entry sizes and any
+	// content digests differ from the source. See the text-eol exporter
+	// option.
+	textEOL        string
+	textEOLMatcher *patternmatcher.PatternMatcher
+	// dedupHardlinks rewrites duplicate regular files as hardlink entries
+	// pointing at the first occurrence of the same content.
+	dedupHardlinks bool
+	// symlinkMode selects how symlinks are serialized: preserved as
+	// symlink entries (default), dereferenced to their target's content,
+	// or rejected. See the symlinks exporter option.
+	symlinkMode string
+	// brokenSymlinks selects handling for symlinks whose target cannot be
+	// resolved within the exported tree: kept (default), logged, or
+	// rejected. See the broken-symlinks exporter option.
+	brokenSymlinks string
+	// specialFiles selects how device nodes, FIFOs and sockets are
+	// handled: kept as their tar entry types (default), skipped, or
+	// rejected. See the special-files exporter option.
+	specialFiles string
+	// sparse stores regular files with holes as GNU sparse 1.0 members
+	// instead of expanding them to their full size. See the sparse
+	// exporter option.
+	sparse bool
+	// pruneEmptyDirs drops directory entries with no remaining
+	// descendants, recursively, so chains of empty scaffold directories
+	// do not bloat the archive. Directories matching a keepEmptyDirs
+	// pattern are retained even when empty.
+	pruneEmptyDirs bool
+	keepEmptyDirs  []string
+	// recordSize pads the end of the tar stream to a multiple of this
+	// size in bytes, zero meaning plain 512-byte blocking. See the
+	// tar-blocking-factor exporter option. align pads the same way but
+	// accepts any power-of-two boundary; the two are mutually exclusive.
+	// See the align exporter option.
+	recordSize int64
+	align      int64
+	// defaultUname/defaultGname fill in empty textual owner names;
+	// unameMap/gnameMap override names for specific ids. Applied after
+	// deterministic normalization so configured names survive it.
+	defaultUname string
+	defaultGname string
+	unameMap     map[int]string
+	gnameMap     map[int]string
+	// maxFileSize and maxTotalSize abort the export when a single file,
+	// or the sum of all entries, exceeds the limit. Zero means unlimited.
+	// See the max-file-size and max-total-size exporter options.
+	maxFileSize  int64
+	maxTotalSize int64
+	// expectFiles fails the export when the number of regular-file
+	// entries differs from the given count. Nil disables the check. See
+	// the expect-files exporter option.
+	expectFiles *int
+	// checksums, when set to "sha256", digests every regular file while
+	// it is written and appends a SHA256SUMS manifest entry at the root
+	// of the tree (or of each platform subtree). checksumMtime is the
+	// modification time used for the synthetic manifest entry.
+	checksums     string
+	checksumMtime time.Time
+	// caseFold selects handling for case-insensitive extraction targets:
+	// "lower" rewrites all paths to lowercase, "detect" leaves paths
+	// untouched but rejects the export when two entries collide under
+	// case folding. Empty leaves paths as-is. See the casefold exporter
+	// option.
+	caseFold string
+	// whiteoutMode selects how layer whiteouts are serialized: kept
+	// verbatim (default), stripped from the export, or converted from
+	// overlayfs representation (0:0 char devices, opaque xattrs) to the
+	// OCI .wh. naming convention. See the whiteouts exporter option.
+	whiteoutMode string
+	// uidMap/gidMap remap entry ownership using container:host:size
+	// ranges. With mapStrict, ids not covered by any range are an error;
+	// otherwise they pass through unchanged.
+	uidMap    []idMapEntry
+	gidMap    []idMapEntry
+	mapStrict bool
+	// headerMutator, when non-nil, runs on every header after all
+	// option-driven transformations and before the entry is recorded. See
+	// HeaderMutator for the contract.
+	headerMutator HeaderMutator
+}
+
+// idMapEntry remaps the id range [container, container+size) to
+// [host, host+size), following the runc idmap grammar.
+type idMapEntry struct {
+	container int
+	host      int
+	size      int
+}
+
+func mapID(m []idMapEntry, id int) (int, bool) {
+	for _, e := range m {
+		if id >= e.container && id < e.container+e.size {
+			return e.host + (id - e.container), true
+		}
+	}
+	return id, false
+}
+
+// chmodRule overrides the permission bits of entries matching an
+// fsutil-style pattern, as parsed from the chmod exporter option.
+type chmodRule struct {
+	matcher *patternmatcher.PatternMatcher
+	mode    int64
+}
+
+type tarEntry struct {
+	path string
+	hdr  *tar.Header
+}
+
+const (
+	// whiteoutPrefix marks deleted files in the OCI layer convention;
+	// opaqueWhiteout marks a directory whose lower content is hidden.
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+
+	// capabilityXattr is the extended attribute holding file capabilities,
+	// as written by setcap(8).
+	capabilityXattr = "security.capability"
+)
+
+// isOpaqueDir reports whether the stat carries an overlayfs opaque marker.
+func isOpaqueDir(stat *types.Stat) bool {
+	for _, k := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		if string(stat.Xattrs[k]) == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTar writes fs as a tar stream to w. It mirrors fsutil.WriteTar but
+// allows the exporter to customize entry handling via opts.
+func writeTar(ctx context.Context, fs fsutil.FS, w io.Writer, opts writeTarOpts) error {
+	_, err := writeTarCount(ctx, fs, w, opts)
+	return err
+}
+
+// writeTarCount is writeTar but additionally reports how many entries
+// were written, for the export summary.
+func writeTarCount(ctx context.Context, fs fsutil.FS, w io.Writer, opts writeTarOpts) (int, error) {
+	entries, err := collectTarEntries(ctx, fs, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var rec *countingWriter
+	if opts.recordSize > 0 || opts.align > 0 {
+		rec = &countingWriter{w: w}
+		w = rec
+	}
+	tw := tar.NewWriter(w)
+	cs := newChecksumCollector(opts)
+	var regularFiles int
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := writeTarEntry(ctx, fs, tw, w, e, opts, cs); err != nil {
+			return 0, err
+		}
+		if e.hdr.Typeflag == tar.TypeReg {
+			regularFiles++
+		}
+	}
+	if err := checkExpectFiles(regularFiles, opts); err != nil {
+		return 0, err
+	}
+	if cs != nil {
+		if err := cs.writeManifest(tw, "", opts); err != nil {
+			return 0, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if rec != nil {
+		if err := padToRecordSize(rec, padSize(opts)); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// checkExpectFiles compares the number of regular-file entries written
+// against the expect-files option, before the stream is finalized.
+func checkExpectFiles(regularFiles int, opts writeTarOpts) error {
+	if opts.expectFiles == nil {
+		return nil
+	}
+	if regularFiles != *opts.expectFiles {
+		return errors.Errorf("%s: wrote %d regular files, expected %d", expectFilesKey, regularFiles, *opts.expectFiles)
+	}
+	return nil
+}
+
+// padSize returns the boundary the stream is padded to: the blocking
+// record size or the align option, whichever is configured (they are
+// mutually exclusive).
+func padSize(opts writeTarOpts) int64 {
+	if opts.recordSize > 0 {
+		return opts.recordSize
+	}
+	return opts.align
+}
+
+// padToRecordSize zero-pads the stream counted by cw up to a multiple of
+// the configured record size.
+func padToRecordSize(cw *countingWriter, recordSize int64) error {
+	if pad := cw.n % recordSize; pad != 0 {
+		if _, err := cw.Write(make([]byte, recordSize-pad)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newChecksumCollector returns a collector when the checksums option is
+// enabled, nil otherwise.
+func newChecksumCollector(opts writeTarOpts) *checksumCollector {
+	if opts.checksums == "" {
+		return nil
+	}
+	return &checksumCollector{}
+}
+
+// writeTarParts writes fs as a sequence of tar streams, starting a new part
+// via newPart whenever the current part reaches splitSize bytes of tar data.
+// Parts are only split between whole entries, so a single entry may push a
+// part past the threshold. It returns the tar stream size of each part and
+// the number of entries written. On failure - including cancellation - the
+// sizes of the parts already closed are still returned: those parts were
+// fully delivered to their writers and remain valid, only the in-progress
+// part is lost.
+func writeTarParts(ctx context.Context, fs fsutil.FS, opts writeTarOpts, newPart func() (io.WriteCloser, error), splitSize int64) ([]int64, int, error) {
+	entries, err := collectTarEntries(ctx, fs, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var sizes []int64
+	var wc io.WriteCloser
+	var cw *countingWriter
+	var tw *tar.Writer
+	cs := newChecksumCollector(opts)
+
+	openPart := func() error {
+		var err error
+		wc, err = newPart()
+		if err != nil {
+			return err
+		}
+		cw = &countingWriter{w: wc}
+		tw = tar.NewWriter(cw)
+		return nil
+	}
+	closePart := func() error {
+		err := tw.Close()
+		if err == nil && padSize(opts) > 0 {
+			err = padToRecordSize(cw, padSize(opts))
+		}
+		if err1 := wc.Close(); err == nil {
+			err = err1
+		}
+		if err == nil {
+			sizes = append(sizes, cw.n)
+		}
+		tw = nil
+		return err
+	}
+
+	var regularFiles int
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return sizes, 0, err
+		}
+		if tw == nil {
+			if err := openPart(); err != nil {
+				return sizes, 0, err
+			}
+		}
+		if err := writeTarEntry(ctx, fs, tw, cw, e, opts, cs); err != nil {
+			wc.Close()
+			return sizes, 0, err
+		}
+		if e.hdr.Typeflag == tar.TypeReg {
+			regularFiles++
+		}
+		if err := tw.Flush(); err != nil {
+			wc.Close()
+			return sizes, 0, err
+		}
+		if cw.n >= splitSize {
+			if err := closePart(); err != nil {
+				return sizes, 0, err
+			}
+		}
+	}
+
+	if err := checkExpectFiles(regularFiles, opts); err != nil {
+		if tw != nil {
+			wc.Close()
+		}
+		return sizes, 0, err
+	}
+
+	if tw == nil && len(sizes) == 0 {
+		// always produce at least one (possibly empty) part
+		if err := openPart(); err != nil {
+			return sizes, 0, err
+		}
+	}
+	if cs != nil {
+		// the manifest goes into the last part; reopen one if the final
+		// entry closed it exactly at the threshold
+		if tw == nil {
+			if err := openPart(); err != nil {
+				return sizes, 0, err
+			}
+		}
+		if err := cs.writeManifest(tw, "", opts); err != nil {
+			wc.Close()
+			return sizes, 0, err
+		}
+	}
+	if tw != nil {
+		if err := closePart(); err != nil {
+			return sizes, 0, err
+		}
+	}
+	return sizes, len(entries), nil
+}
+
+// writeTarEntries writes the entries of fs into an existing tar writer,
+// prefixing every entry name. Used by the streaming export path, where each
+// platform's filesystem is written and released before the next one is
+// mounted.
+func writeTarEntries(ctx context.Context, fs fsutil.FS, tw *tar.Writer, raw io.Writer, prefix string, opts writeTarOpts) error {
+	_, err := writeTarEntriesCount(ctx, fs, tw, raw, prefix, opts)
+	return err
+}
+
+// writeTarEntriesCount is writeTarEntries but additionally reports how many
+// entries were written, for the export summary.
+func writeTarEntriesCount(ctx context.Context, fs fsutil.FS, tw *tar.Writer, raw io.Writer, prefix string, opts writeTarOpts) (int, error) {
+	entries, err := collectTarEntries(ctx, fs, opts)
+	if err != nil {
+		return 0, err
+	}
+	cs := newChecksumCollector(opts)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		e.hdr.Name = prefix + e.hdr.Name
+		if e.hdr.Typeflag == tar.TypeLink {
+			// hardlink targets name another entry of the same fs, so
+			// they move along with the prefix
+			e.hdr.Linkname = prefix + e.hdr.Linkname
+		}
+		if err := writeTarEntry(ctx, fs, tw, raw, e, opts, cs); err != nil {
+			return 0, err
+		}
+	}
+	if cs != nil {
+		// each streamed subtree gets its own manifest under its prefix
+		if err := cs.writeManifest(tw, prefix, opts); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// writeTarDirHeader emits a synthetic directory entry, as used for the
+// platform subdirectories in streaming mode.
+func writeTarDirHeader(tw *tar.Writer, name string, mtime time.Time, format tar.Format) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  mtime,
+		Format:   format,
+	}
+	return errors.Wrapf(tw.WriteHeader(hdr), "failed to write dir header %s", name)
+}
+
+// contextReader fails reads once ctx is canceled, bounding how long a
+// canceled export keeps the session and cache mounts alive mid-copy.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func collectTarEntries(ctx context.Context, fs fsutil.FS, opts writeTarOpts) ([]tarEntry, error) {
+	var entries []tarEntry
+	var totalSize int64
+
+	err := fs.Walk(ctx, func(path string, fi os.FileInfo, err error) error {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		stat, ok := fi.Sys().(*types.Stat)
+		if !ok {
+			return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			if opts.specialFiles == specialFilesError {
+				return errors.Errorf("refusing to export special file %s (%s=%s)", path, specialFilesKey, specialFilesError)
+			}
+			// tar has no socket entry type
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, stat.Linkname)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(path)
+		if fi.IsDir() && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		hdr.Name = name
+
+		hdr.Uid = int(stat.Uid)
+		hdr.Gid = int(stat.Gid)
+		if len(opts.uidMap) > 0 {
+			uid, ok := mapID(opts.uidMap, hdr.Uid)
+			if !ok && opts.mapStrict {
+				return errors.Errorf("uid %d for %s not covered by uid-map", hdr.Uid, path)
+			}
+			hdr.Uid = uid
+		}
+		if len(opts.gidMap) > 0 {
+			gid, ok := mapID(opts.gidMap, hdr.Gid)
+			if !ok && opts.mapStrict {
+				return errors.Errorf("gid %d for %s not covered by gid-map", hdr.Gid, path)
+			}
+			hdr.Gid = gid
+		}
+		hdr.Devmajor = stat.Devmajor
+		hdr.Devminor = stat.Devminor
+		hdr.Linkname = stat.Linkname
+		if hdr.Linkname != "" {
+			hdr.Size = 0
+			if fi.Mode()&os.ModeSymlink != 0 {
+				hdr.Typeflag = tar.TypeSymlink
+			} else {
+				hdr.Typeflag = tar.TypeLink
+			}
+		}
+
+		if opts.preserveXattrs {
+			if len(stat.Xattrs) > 0 {
+				hdr.PAXRecords = map[string]string{}
+			}
+			for k, v := range stat.Xattrs {
+				hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+			}
+		} else if opts.preserveCaps {
+			if v, ok := stat.Xattrs[capabilityXattr]; ok {
+				hdr.PAXRecords = map[string]string{
+					"SCHILY.xattr." + capabilityXattr: string(v),
+				}
+			}
+		}
+
+		if opts.stripSpecialBits {
+			hdr.Mode &^= 07000 // setuid, setgid, sticky
+		}
+
+		if hdr.Typeflag != tar.TypeSymlink {
+			for _, r := range opts.chmodRules {
+				m, err := r.matcher.MatchesOrParentMatches(strings.TrimSuffix(name, "/"))
+				if err != nil {
+					return errors.Wrapf(err, "failed to match %s against chmod pattern", name)
+				}
+				if m {
+					hdr.Mode = hdr.Mode&^07777 | r.mode
+				}
+			}
+		}
+
+		var opaqueMarker *tar.Header
+		switch opts.whiteoutMode {
+		case whiteoutsStrip:
+			if strings.HasPrefix(filepath.Base(name), whiteoutPrefix) {
+				return nil
+			}
+		case whiteoutsConvert:
+			if hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0 {
+				// overlayfs marks deleted files with a 0:0 char device
+				hdr.Typeflag = tar.TypeReg
+				hdr.Name = filepath.ToSlash(filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name)))
+				hdr.Mode = 0600
+				hdr.Size = 0
+				hdr.Devmajor = 0
+				hdr.Devminor = 0
+			}
+			if hdr.Typeflag == tar.TypeDir && isOpaqueDir(stat) {
+				delete(hdr.PAXRecords, "SCHILY.xattr.trusted.overlay.opaque")
+				delete(hdr.PAXRecords, "SCHILY.xattr.user.overlay.opaque")
+				opaqueMarker = &tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     name + opaqueWhiteout,
+					Mode:     0600,
+					ModTime:  hdr.ModTime,
+					Uid:      hdr.Uid,
+					Gid:      hdr.Gid,
+				}
+			}
+		}
+
+		if opts.maxFileSize > 0 && hdr.Size > opts.maxFileSize {
+			return errors.Errorf("file %s is %d bytes, exceeding %s=%d", path, hdr.Size, maxFileSizeKey, opts.maxFileSize)
+		}
+		if opts.maxTotalSize > 0 {
+			totalSize += hdr.Size
+			if totalSize > opts.maxTotalSize {
+				return errors.Errorf("export exceeds %s=%d at %s", maxTotalSizeKey, opts.maxTotalSize, path)
+			}
+		}
+
+		// after the whiteout handling so converted whiteout markers are
+		// never treated as device nodes
+		switch hdr.Typeflag {
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			switch opts.specialFiles {
+			case specialFilesSkip:
+				return nil
+			case specialFilesError:
+				return errors.Errorf("refusing to export special file %s (%s=%s)", path, specialFilesKey, specialFilesError)
+			}
+		}
+
+		if opts.deterministic {
+			normalizeHeader(hdr)
+		}
+		if n, ok := opts.unameMap[hdr.Uid]; ok {
+			hdr.Uname = n
+		} else if opts.defaultUname != "" && hdr.Uname == "" {
+			hdr.Uname = opts.defaultUname
+		}
+		if n, ok := opts.gnameMap[hdr.Gid]; ok {
+			hdr.Gname = n
+		} else if opts.defaultGname != "" && hdr.Gname == "" {
+			hdr.Gname = opts.defaultGname
+		}
+		if opts.format != tar.FormatUnknown {
+			hdr.Format = opts.format
+		}
+
+		if err := applyHeaderMutator(hdr, opts); err != nil {
+			return err
+		}
+		entries = append(entries, tarEntry{path: path, hdr: hdr})
+		if opaqueMarker != nil {
+			if opts.deterministic {
+				normalizeHeader(opaqueMarker)
+			}
+			if opts.format != tar.FormatUnknown {
+				opaqueMarker.Format = opts.format
+			}
+			if err := applyHeaderMutator(opaqueMarker, opts); err != nil {
+				return err
+			}
+			entries = append(entries, tarEntry{hdr: opaqueMarker})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.pruneEmptyDirs {
+		entries, err = pruneEmptyDirEntries(entries, opts.keepEmptyDirs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.caseFold != "" {
+		// runs before the deterministic sort so folded names sort in
+		// their final spelling
+		seen := make(map[string]string, len(entries))
+		for i := range entries {
+			e := &entries[i]
+			lower := strings.ToLower(e.hdr.Name)
+			if prev, ok := seen[lower]; ok {
+				return nil, errors.Errorf("case-insensitive path collision between %s and %s", prev, e.hdr.Name)
+			}
+			seen[lower] = e.hdr.Name
+			if opts.caseFold == casefoldLower {
+				e.hdr.Name = lower
+				if e.hdr.Typeflag == tar.TypeLink {
+					e.hdr.Linkname = strings.ToLower(e.hdr.Linkname)
+				}
+			}
+		}
+	}
+	if opts.deterministic {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].hdr.Name < entries[j].hdr.Name
+		})
+	}
+	if opts.strictDeterministic {
+		if err := checkStrictDeterminism(entries, opts); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.symlinkMode {
+	case "", symlinksPreserve:
+	case symlinksError:
+		for _, e := range entries {
+			if e.hdr.Typeflag == tar.TypeSymlink {
+				return nil, errors.Errorf("export contains symlink %s -> %s, rejected by symlinks=%s", e.hdr.Name, e.hdr.Linkname, symlinksError)
+			}
+		}
+	case symlinksFollow:
+		if err := followSymlinkEntries(entries); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.brokenSymlinks {
+	case "", brokenSymlinksKeep:
+	case brokenSymlinksWarn, brokenSymlinksError:
+		if err := checkBrokenSymlinkEntries(ctx, entries, opts.brokenSymlinks == brokenSymlinksError); err != nil {
+			return nil, err
+		}
+	}
+	if opts.dedupHardlinks {
+		if err := dedupHardlinkEntries(ctx, fs, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// checkBrokenSymlinkEntries resolves the immediate target of every symlink
+// within the exported tree and reports the ones that dangle: targets
+// missing from the tree or pointing outside it. A link into a chain is
+// only checked one hop deep; a broken chain is reported at the inner link
+// that actually dangles. With strict set the first offender fails the
+// export, otherwise each one is logged.
+func checkBrokenSymlinkEntries(ctx context.Context, entries []tarEntry, strict bool) error {
+	byName := make(map[string]struct{}, len(entries))
+	for i := range entries {
+		byName[strings.TrimSuffix(entries[i].hdr.Name, "/")] = struct{}{}
+	}
+	for _, e := range entries {
+		if e.hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		link := e.hdr.Linkname
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(e.hdr.Name), link)
+		}
+		link = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(link)), "/")
+		if _, ok := byName[link]; ok {
+			continue
+		}
+		if strict {
+			return errors.Errorf("broken symlink %s -> %s, rejected by %s=%s", e.hdr.Name, e.hdr.Linkname, brokenSymlinksKey, brokenSymlinksError)
+		}
+		bklog.G(ctx).Warnf("export contains broken symlink %s -> %s", e.hdr.Name, e.hdr.Linkname)
+	}
+	return nil
+}
+
+// pruneEmptyDirEntries removes directory entries that have no remaining
+// descendants. A directory containing only other empty directories counts
+// as empty itself: ancestors are only marked live from entries that
+// survive, so empty chains collapse bottom-up. Directories matching a
+// keep pattern survive regardless and keep their ancestors alive.
+func pruneEmptyDirEntries(entries []tarEntry, keep []string) ([]tarEntry, error) {
+	nonEmpty := map[string]struct{}{}
+	mark := func(name string) {
+		name = strings.TrimSuffix(name, "/")
+		for {
+			i := strings.LastIndex(name, "/")
+			if i < 0 {
+				return
+			}
+			name = name[:i]
+			if _, ok := nonEmpty[name]; ok {
+				return
+			}
+			nonEmpty[name] = struct{}{}
+		}
+	}
+	for _, e := range entries {
+		if e.hdr.Typeflag != tar.TypeDir {
+			mark(e.hdr.Name)
+			continue
+		}
+		dir := strings.TrimSuffix(e.hdr.Name, "/")
+		for _, pat := range keep {
+			ok, err := filepath.Match(pat, dir)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid keep-empty-dirs pattern %s", pat)
+			}
+			if ok {
+				nonEmpty[dir] = struct{}{}
+				mark(e.hdr.Name)
+				break
+			}
+		}
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if e.hdr.Typeflag == tar.TypeDir {
+			if _, ok := nonEmpty[strings.TrimSuffix(e.hdr.Name, "/")]; !ok {
+				continue
+			}
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// followSymlinkEntries replaces symlink entries with regular file entries
+// carrying their target's content. Targets are resolved strictly within
+// the walked filesystem, so out-of-tree links are an error rather than a
+// host file leak, and chains are followed with a hop limit to catch
+// loops. Only links that ultimately reach a regular file can be followed.
+func followSymlinkEntries(entries []tarEntry) error {
+	byName := make(map[string]*tarEntry, len(entries))
+	for i := range entries {
+		byName[strings.TrimSuffix(entries[i].hdr.Name, "/")] = &entries[i]
+	}
+	const maxHops = 40 // mirrors the kernel's ELOOP limit
+	for i := range entries {
+		e := &entries[i]
+		if e.hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		name := e.hdr.Name
+		target := e
+		for hops := 0; target.hdr.Typeflag == tar.TypeSymlink; hops++ {
+			if hops >= maxHops {
+				return errors.Errorf("too many levels of symlinks following %s", name)
+			}
+			link := target.hdr.Linkname
+			if !filepath.IsAbs(link) {
+				link = filepath.Join(filepath.Dir(target.hdr.Name), link)
+			}
+			link = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(link)), "/")
+			next, ok := byName[link]
+			if !ok {
+				return errors.Errorf("cannot follow symlink %s: target %s is outside the export", name, target.hdr.Linkname)
+			}
+			target = next
+		}
+		if target.hdr.Typeflag != tar.TypeReg {
+			return errors.Errorf("cannot follow symlink %s: target %s is not a regular file", name, target.hdr.Name)
+		}
+		hdr := *target.hdr
+		hdr.Name = name
+		e.hdr = &hdr
+		e.path = target.path
+	}
+	return nil
+}
+
+// dedupHardlinkEntries rewrites duplicate regular files as hardlink entries
+// pointing at the first occurrence in entry order. fsutil does not expose
+// inode numbers across its FS abstraction, so duplicates are detected by
+// content digest; files sharing an inode necessarily share content and are
+// caught by the same check. Runs after any sorting so the link target is
+// always written before its links.
+func dedupHardlinkEntries(ctx context.Context, fs fsutil.FS, entries []tarEntry) error {
+	type fileKey struct {
+		dgst digest.Digest
+		size int64
+	}
+	seen := map[fileKey]string{}
+	for _, e := range entries {
+		if e.hdr.Typeflag != tar.TypeReg || e.hdr.Size == 0 || e.hdr.Linkname != "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f, err := fs.Open(e.path)
+		if err != nil {
+			return err
+		}
+		d := digest.Canonical.Digester()
+		_, err = io.Copy(d.Hash(), f)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to hash %s for hardlink dedup", e.path)
+		}
+		key := fileKey{dgst: d.Digest(), size: e.hdr.Size}
+		if first, ok := seen[key]; ok {
+			e.hdr.Typeflag = tar.TypeLink
+			e.hdr.Linkname = first
+			e.hdr.Size = 0
+		} else {
+			seen[key] = e.hdr.Name
+		}
+	}
+	return nil
+}
+
+func writeTarEntry(ctx context.Context, fs fsutil.FS, tw *tar.Writer, raw io.Writer, e tarEntry, opts writeTarOpts, cs *checksumCollector) error {
+	if opts.textEOL != "" && e.hdr.Typeflag == tar.TypeReg && e.hdr.Size > 0 && e.hdr.Linkname == "" {
+		done, err := writeTextEOLEntry(ctx, fs, tw, e, opts, cs)
+		if err != nil || done {
+			return err
+		}
+	}
+	if opts.sparse && raw != nil && e.hdr.Typeflag == tar.TypeReg && e.hdr.Size > 0 && e.hdr.Linkname == "" {
+		done, err := writeSparseTarEntry(tw, raw, fs, e)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	if err := tw.WriteHeader(e.hdr); err != nil {
+		return errors.Wrapf(err, "failed to write file header %s", e.hdr.Name)
+	}
+	if e.hdr.Typeflag == tar.TypeReg && e.hdr.Size > 0 && e.hdr.Linkname == "" {
+		rc, err := fs.Open(e.path)
+		if err != nil {
+			return err
+		}
+		var w io.Writer = tw
+		if cs != nil {
+			w = io.MultiWriter(tw, cs.begin(e.hdr.Name))
+		}
+		// long file copies would otherwise only notice cancellation at
+		// the next entry boundary
+		if _, err := io.Copy(w, &contextReader{ctx: ctx, r: rc}); err != nil {
+			return errors.WithStack(err)
+		}
+		if cs != nil {
+			cs.commit()
+		}
+		if err := rc.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// textSniffLen is how many leading bytes are inspected for null bytes to
+// tell text files from binaries before line-ending normalization.
+const textSniffLen = 8192
+
+// writeTextEOLEntry writes a regular file with its line endings normalized
+// per the text-eol option. It reports done=false without writing anything
+// when the entry is not a candidate - the name does not match the
+// configured globs, or the content sniffs as binary - leaving it to the
+// regular write path. The content is buffered in full to compute the
+// rewritten size for the header, so the option is meant for source trees,
+// not multi-gigabyte files.
+func writeTextEOLEntry(ctx context.Context, fs fsutil.FS, tw *tar.Writer, e tarEntry, opts writeTarOpts, cs *checksumCollector) (bool, error) {
+	if opts.textEOLMatcher != nil {
+		m, err := opts.textEOLMatcher.MatchesOrParentMatches(e.hdr.Name)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to match %s against %s pattern", e.hdr.Name, textEOLGlobsKey)
+		}
+		if !m {
+			return false, nil
+		}
+	}
+	rc, err := fs.Open(e.path)
+	if err != nil {
+		return false, err
+	}
+	dt, err := io.ReadAll(&contextReader{ctx: ctx, r: rc})
+	if err1 := rc.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	sniff := dt
+	if len(sniff) > textSniffLen {
+		sniff = sniff[:textSniffLen]
+	}
+	if bytes.IndexByte(sniff, 0) >= 0 {
+		// binary content is left alone even when its name matches
+		return false, nil
+	}
+	dt = normalizeEOL(dt, opts.textEOL)
+	hdr := *e.hdr
+	hdr.Size = int64(len(dt))
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return false, errors.Wrapf(err, "failed to write file header %s", hdr.Name)
+	}
+	var w io.Writer = tw
+	if cs != nil {
+		w = io.MultiWriter(tw, cs.begin(hdr.Name))
+	}
+	if _, err := w.Write(dt); err != nil {
+		return false, errors.WithStack(err)
+	}
+	if cs != nil {
+		cs.commit()
+	}
+	return true, nil
+}
+
+// normalizeEOL rewrites line endings: "lf" turns CRLF sequences into LF,
+// "crlf" turns lone LFs into CRLF. Both pass through the LF form first so
+// mixed-ending files come out uniform.
+func normalizeEOL(dt []byte, mode string) []byte {
+	lf := bytes.ReplaceAll(dt, []byte("\r\n"), []byte("\n"))
+	if mode == textEOLLF {
+		return lf
+	}
+	return bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+}
+
+// checkStrictDeterminism rejects inputs that deterministic normalization
+// cannot make reproducible, so auditors get a precise diagnostic instead
+// of a "mostly" stable tar.
+func checkStrictDeterminism(entries []tarEntry, opts writeTarOpts) error {
+	seen := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		name := e.hdr.Name
+		if _, ok := seen[name]; ok {
+			return errors.Errorf("%s=%s: duplicate entry %s has no stable order", deterministicKey, deterministicStrict, name)
+		}
+		seen[name] = struct{}{}
+		switch e.hdr.Typeflag {
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return errors.Errorf("%s=%s: special file %s is not reproducible (use %s to skip or reject it)", deterministicKey, deterministicStrict, name, specialFilesKey)
+		}
+		if !opts.epochPinned && e.hdr.ModTime.Nanosecond() != 0 {
+			return errors.Errorf("%s=%s: %s has sub-second mtime %s; set %s to pin timestamps", deterministicKey, deterministicStrict, name, e.hdr.ModTime.Format(time.RFC3339Nano), epoch.KeySourceDateEpoch)
+		}
+	}
+	return nil
+}
+
+// applyHeaderMutator runs the embedder-provided header hook and verifies
+// the mutated name still resolves within the exported tree. It runs before
+// the post-walk passes (sorting, case folding, symlink handling) so
+// renamed entries flow through them under their final name.
+func applyHeaderMutator(hdr *tar.Header, opts writeTarOpts) error {
+	if opts.headerMutator == nil {
+		return nil
+	}
+	orig := hdr.Name
+	if err := opts.headerMutator(hdr); err != nil {
+		return errors.Wrapf(err, "header mutator failed for %s", orig)
+	}
+	cleaned := filepath.ToSlash(filepath.Clean(hdr.Name))
+	if filepath.IsAbs(hdr.Name) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return errors.Errorf("header mutator moved %s outside the exported tree: %s", orig, hdr.Name)
+	}
+	return nil
+}
+
+// normalizeHeader clears header fields that vary between hosts or runs so
+// deterministic exports produce stable bytes.
+func normalizeHeader(hdr *tar.Header) {
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Format = tar.FormatPAX
+}
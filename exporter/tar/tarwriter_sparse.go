@@ -0,0 +1,182 @@
+package local
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+)
+
+// sparseSeg describes one populated data segment of a sparse file; the
+// ranges between segments are holes.
+type sparseSeg struct {
+	offset int64
+	length int64
+}
+
+const tarBlockSize = 512
+
+// writeSparseTarEntry stores e in the GNU sparse 1.0 representation when
+// the source file has holes. archive/tar cannot emit sparse members, so
+// the member is written as raw blocks to the writer underneath tw,
+// flushing tw first so the stream stays well-formed around it. Returns
+// false when the file has no holes, or the filesystem cannot report them,
+// and the entry should be stored verbatim instead.
+func writeSparseTarEntry(tw *tar.Writer, raw io.Writer, fs fsutil.FS, e tarEntry) (bool, error) {
+	rc, err := fs.Open(e.path)
+	if err != nil {
+		return false, err
+	}
+	f, ok := rc.(*os.File)
+	if !ok {
+		rc.Close()
+		return false, nil
+	}
+	segs, ok := detectSparseSegs(f, e.hdr.Size)
+	if !ok {
+		f.Close()
+		return false, nil
+	}
+	defer f.Close()
+	if err := tw.Flush(); err != nil {
+		return false, err
+	}
+	return true, errors.Wrapf(writeSparseMember(raw, e.hdr, f, segs), "failed to write sparse entry %s", e.hdr.Name)
+}
+
+// writeSparseMember writes one tar member in the GNU sparse 1.0 layout: a
+// pax extended header carrying the sparse records, a file header sized to
+// the stored (compacted) data, a block-aligned decimal map of the data
+// segments, and finally the segment bytes back to back. Readers that
+// understand the format (GNU tar, bsdtar, archive/tar) reassemble the
+// holes from the map; anything else extracts the compacted representation.
+func writeSparseMember(w io.Writer, hdr *tar.Header, f *os.File, segs []sparseSeg) error {
+	var stored int64
+	var mapBuf bytes.Buffer
+	fmt.Fprintf(&mapBuf, "%d\n", len(segs))
+	for _, s := range segs {
+		fmt.Fprintf(&mapBuf, "%d\n%d\n", s.offset, s.length)
+		stored += s.length
+	}
+	if pad := mapBuf.Len() % tarBlockSize; pad != 0 {
+		mapBuf.Write(make([]byte, tarBlockSize-pad))
+	}
+	size := int64(mapBuf.Len()) + stored
+
+	var recs bytes.Buffer
+	for _, r := range [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", hdr.Name},
+		{"GNU.sparse.realsize", strconv.FormatInt(hdr.Size, 10)},
+		{"path", hdr.Name},
+		{"size", strconv.FormatInt(size, 10)},
+	} {
+		recs.WriteString(paxRecord(r[0], r[1]))
+	}
+
+	mtime := hdr.ModTime.Unix()
+	if err := writeRawTarHeader(w, "PaxHeaders.0/"+hdr.Name, 0600, 0, 0, int64(recs.Len()), mtime, tar.TypeXHeader); err != nil {
+		return err
+	}
+	if err := writePadded(w, recs.Bytes()); err != nil {
+		return err
+	}
+	if err := writeRawTarHeader(w, hdr.Name, hdr.Mode, hdr.Uid, hdr.Gid, size, mtime, tar.TypeReg); err != nil {
+		return err
+	}
+	if _, err := w.Write(mapBuf.Bytes()); err != nil {
+		return err
+	}
+	var written int64
+	for _, s := range segs {
+		if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, f, s.length); err != nil {
+			return err
+		}
+		written += s.length
+	}
+	if pad := written % tarBlockSize; pad != 0 {
+		if _, err := w.Write(make([]byte, tarBlockSize-pad)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paxRecord formats one pax extended header record; the leading length
+// covers the whole record including itself.
+func paxRecord(k, v string) string {
+	const padding = 3 // space, '=', newline
+	size := len(k) + len(v) + padding
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(record) != size {
+		// adding the length field grew its own digit count
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// writeRawTarHeader writes a single ustar header block. Values that do not
+// fit the fixed octal fields are clamped; callers carry the exact values
+// in pax records.
+func writeRawTarHeader(w io.Writer, name string, mode int64, uid, gid int, size, mtime int64, typeflag byte) error {
+	var blk [tarBlockSize]byte
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	copy(blk[0:100], name)
+	octalField(blk[100:108], mode&07777)
+	octalField(blk[108:116], int64(uid))
+	octalField(blk[116:124], int64(gid))
+	octalField(blk[124:136], size)
+	octalField(blk[136:148], mtime)
+	blk[156] = typeflag
+	copy(blk[257:265], "ustar\x0000")
+
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, b := range blk {
+		sum += int64(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	_, err := w.Write(blk[:])
+	return err
+}
+
+func octalField(b []byte, v int64) {
+	if v < 0 {
+		v = 0
+	}
+	s := strconv.FormatInt(v, 8)
+	if len(s) > len(b)-1 {
+		// too large for the field; pax records carry the real value
+		s = "0"
+	}
+	for i := 0; i < len(b)-1-len(s); i++ {
+		b[i] = '0'
+	}
+	copy(b[len(b)-1-len(s):], s)
+}
+
+func writePadded(w io.Writer, dt []byte) error {
+	if _, err := w.Write(dt); err != nil {
+		return err
+	}
+	if pad := len(dt) % tarBlockSize; pad != 0 {
+		if _, err := w.Write(make([]byte, tarBlockSize-pad)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package local
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// detectSparseSegs maps the populated data segments of f using
+// SEEK_DATA/SEEK_HOLE. It returns ok=false when the file has no holes, or
+// the filesystem cannot report them, in which case the caller should
+// store the file verbatim.
+func detectSparseSegs(f *os.File, size int64) ([]sparseSeg, bool) {
+	segs := []sparseSeg{}
+	var off int64
+	for off < size {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, unix.ENXIO) {
+				break // only a hole remains before EOF
+			}
+			return nil, false // filesystem does not support hole detection
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, false
+		}
+		segs = append(segs, sparseSeg{offset: data, length: hole - data})
+		off = hole
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, false
+	}
+	if len(segs) == 1 && segs[0].offset == 0 && segs[0].length == size {
+		return nil, false // fully populated, nothing to gain
+	}
+	return segs, true
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package local
+
+import "os"
+
+// detectSparseSegs is only implemented on linux; elsewhere files are
+// always stored verbatim.
+func detectSparseSegs(f *os.File, size int64) ([]sparseSeg, bool) {
+	return nil, false
+}
@@ -0,0 +1,571 @@
+package local
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/sys/unix"
+)
+
+func newTestFS(t *testing.T) fsutil.FS {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zz.txt"), []byte("zz"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "aa.txt"), []byte("aa"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0600))
+	return fsutil.NewFS(dir, &fsutil.WalkOpt{})
+}
+
+func TestWriteTarDeterministic(t *testing.T) {
+	fs := newTestFS(t)
+
+	digest := func() [sha256.Size]byte {
+		buf := &bytes.Buffer{}
+		require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{deterministic: true}))
+		return sha256.Sum256(buf.Bytes())
+	}
+
+	require.Equal(t, digest(), digest())
+}
+
+func TestWriteTarStripSpecialBits(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "suid")
+	require.NoError(t, os.WriteFile(p, []byte("x"), 0755))
+	require.NoError(t, os.Chmod(p, 0755|os.ModeSetuid))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{stripSpecialBits: true}))
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "suid", hdr.Name)
+	require.Equal(t, int64(0755), hdr.Mode&07777)
+}
+
+func TestWriteTarDeterministicNormalizesHeaders(t *testing.T) {
+	fs := newTestFS(t)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{deterministic: true}))
+
+	tr := tar.NewReader(buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, 0, hdr.Uid)
+		require.Equal(t, 0, hdr.Gid)
+		require.Empty(t, hdr.Uname)
+		require.Empty(t, hdr.Gname)
+		names = append(names, hdr.Name)
+	}
+	require.True(t, sort.StringsAreSorted(names))
+}
+
+func TestWriteTarEntriesPlatformSizes(t *testing.T) {
+	// mirrors the accounting done by exportStream: per-platform byte
+	// counts must add up to the tarball size minus the closing blocks
+	buf := &bytes.Buffer{}
+	cw := &countingWriter{w: buf}
+	tw := tar.NewWriter(cw)
+
+	mtime := time.Unix(1000, 0)
+	var sum int64
+	for _, name := range []string{"linux_amd64", "linux_arm64"} {
+		fs := newTestFS(t)
+		start := cw.n
+		require.NoError(t, writeTarDirHeader(tw, name, mtime, tar.FormatUnknown))
+		require.NoError(t, writeTarEntries(context.TODO(), fs, tw, cw, name+"/", writeTarOpts{}))
+		require.NoError(t, tw.Flush())
+		sum += cw.n - start
+	}
+	require.NoError(t, tw.Close())
+
+	// tar.Writer.Close appends two zero blocks after the last entry
+	require.Equal(t, int64(buf.Len()), sum+1024)
+}
+
+func TestWriteTarDedupHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("same content"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("same content"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c.txt"), []byte("different"), 0644))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{dedupHardlinks: true}))
+
+	types := map[string]byte{}
+	links := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		types[hdr.Name] = hdr.Typeflag
+		links[hdr.Name] = hdr.Linkname
+	}
+
+	require.Equal(t, byte(tar.TypeReg), types["a.txt"])
+	require.Equal(t, byte(tar.TypeLink), types["b.txt"])
+	require.Equal(t, "a.txt", links["b.txt"])
+	require.Equal(t, byte(tar.TypeReg), types["c.txt"])
+}
+
+func TestWriteTarSymlinkModes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "target.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.Symlink("target.txt", filepath.Join(dir, "link")))
+	require.NoError(t, os.Symlink("link", filepath.Join(dir, "link2")))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	// error mode rejects the export
+	err := writeTar(context.TODO(), fs, &bytes.Buffer{}, writeTarOpts{symlinkMode: symlinksError})
+	require.ErrorContains(t, err, "symlink")
+
+	// follow mode inlines the target content, including through chains
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{symlinkMode: symlinksFollow}))
+	tr := tar.NewReader(buf)
+	contents := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NotEqual(t, byte(tar.TypeSymlink), hdr.Typeflag)
+		dt, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(dt)
+	}
+	require.Equal(t, "hello", contents["link"])
+	require.Equal(t, "hello", contents["link2"])
+
+	// a link escaping the export root cannot be followed
+	require.NoError(t, os.Symlink("../outside", filepath.Join(dir, "escape")))
+	err = writeTar(context.TODO(), fs, &bytes.Buffer{}, writeTarOpts{symlinkMode: symlinksFollow})
+	require.ErrorContains(t, err, "outside the export")
+}
+
+func TestWriteTarWhiteoutModes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".wh.deleted"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kept.txt"), []byte("x"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "opq"), 0755))
+	require.NoError(t, unix.Setxattr(filepath.Join(dir, "opq"), "user.overlay.opaque", []byte("y"), 0))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	names := func(opts writeTarOpts) []string {
+		buf := &bytes.Buffer{}
+		require.NoError(t, writeTar(context.TODO(), fs, buf, opts))
+		var out []string
+		tr := tar.NewReader(buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			out = append(out, hdr.Name)
+		}
+		return out
+	}
+
+	require.Contains(t, names(writeTarOpts{}), ".wh.deleted")
+
+	stripped := names(writeTarOpts{whiteoutMode: whiteoutsStrip})
+	require.NotContains(t, stripped, ".wh.deleted")
+	require.Contains(t, stripped, "kept.txt")
+
+	converted := names(writeTarOpts{whiteoutMode: whiteoutsConvert})
+	require.Contains(t, converted, ".wh.deleted")
+	require.Contains(t, converted, "opq/.wh..wh..opq")
+}
+
+// cancelAfterWriter cancels the context once n bytes have been written,
+// simulating a client that goes away mid-transfer.
+type cancelAfterWriter struct {
+	cancel  context.CancelFunc
+	n       int
+	written int
+}
+
+func (w *cancelAfterWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	if w.written >= w.n {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+func TestWriteTarCancellation(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big"), bytes.Repeat([]byte("x"), 8<<20), 0644))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelAfterWriter{cancel: cancel, n: 1 << 20}
+
+	err := writeTar(ctx, fs, w, writeTarOpts{})
+	require.ErrorIs(t, err, context.Canceled)
+	// the copy stops shortly after cancellation instead of draining the
+	// whole file
+	require.Less(t, w.written, 2<<20)
+}
+
+func TestWriteTarChecksums(t *testing.T) {
+	fs := newTestFS(t)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{deterministic: true, checksums: checksumsSHA256}))
+
+	var names []string
+	var manifest string
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		if hdr.Name == checksumManifestName {
+			dt, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			manifest = string(dt)
+		}
+	}
+	// the manifest is the last entry
+	require.Equal(t, checksumManifestName, names[len(names)-1])
+
+	sum := sha256.Sum256([]byte("aa"))
+	require.Contains(t, manifest, hex.EncodeToString(sum[:])+"  aa.txt\n")
+	sum = sha256.Sum256([]byte("data"))
+	require.Contains(t, manifest, hex.EncodeToString(sum[:])+"  sub/file\n")
+	// the manifest does not list itself
+	require.NotContains(t, manifest, "  "+checksumManifestName)
+}
+
+func TestWriteTarSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("x"), 0644))
+	require.NoError(t, unix.Mkfifo(filepath.Join(dir, "pipe"), 0600))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	names := func(opts writeTarOpts) []string {
+		buf := &bytes.Buffer{}
+		require.NoError(t, writeTar(context.TODO(), fs, buf, opts))
+		var out []string
+		tr := tar.NewReader(buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			out = append(out, hdr.Name)
+		}
+		return out
+	}
+
+	require.Equal(t, []string{"file", "pipe"}, names(writeTarOpts{}))
+	require.Equal(t, []string{"file"}, names(writeTarOpts{specialFiles: specialFilesSkip}))
+
+	err := writeTar(context.TODO(), fs, io.Discard, writeTarOpts{specialFiles: specialFilesError})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pipe")
+}
+
+func TestWriteTarSparse(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "disk.img")
+	f, err := os.Create(p)
+	require.NoError(t, err)
+	payload := bytes.Repeat([]byte("x"), 4096)
+	_, err = f.Write(payload)
+	require.NoError(t, err)
+	_, err = f.WriteAt(payload, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(2<<20))
+	require.NoError(t, f.Close())
+
+	f, err = os.Open(p)
+	require.NoError(t, err)
+	segs, ok := detectSparseSegs(f, 2<<20)
+	require.NoError(t, f.Close())
+	if !ok {
+		t.Skip("filesystem does not report holes")
+	}
+	require.NotEmpty(t, segs)
+
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{sparse: true}))
+
+	// the stored member is the populated segments plus headers, far below
+	// the 2MiB apparent size
+	require.Less(t, buf.Len(), 64*1024)
+
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "disk.img", hdr.Name)
+	require.Equal(t, int64(2<<20), hdr.Size)
+	dt, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	require.Len(t, dt, 2<<20)
+	require.Equal(t, payload, dt[:4096])
+	require.Equal(t, payload, dt[1<<20:1<<20+4096])
+	for _, b := range dt[4096 : 1<<20] {
+		require.Equal(t, byte(0), b)
+	}
+	_, err = tr.Next()
+	require.Equal(t, io.EOF, err)
+
+	// without the option the file is stored verbatim
+	buf.Reset()
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{}))
+	require.Greater(t, buf.Len(), 2<<20)
+}
+
+func TestWriteTarCasefold(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Makefile"), []byte("b"), 0644))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{caseFold: casefoldLower}))
+	var names []string
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.ElementsMatch(t, []string{"readme", "makefile"}, names)
+
+	// a collision under case folding is an error in both modes
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "readme"), []byte("c"), 0644))
+	err := writeTar(context.TODO(), fs, &bytes.Buffer{}, writeTarOpts{caseFold: casefoldDetect})
+	require.ErrorContains(t, err, "collision")
+	require.ErrorContains(t, err, "README")
+	require.ErrorContains(t, err, "readme")
+	err = writeTar(context.TODO(), fs, &bytes.Buffer{}, writeTarOpts{caseFold: casefoldLower})
+	require.ErrorContains(t, err, "collision")
+
+	// default behavior keeps both spellings
+	require.NoError(t, writeTar(context.TODO(), fs, &bytes.Buffer{}, writeTarOpts{}))
+}
+
+func TestWriteTarPruneEmptyDirs(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "empty", "nested"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "full"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "mnt"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "full", "f"), []byte("x"), 0644))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	names := func(opts writeTarOpts) []string {
+		buf := &bytes.Buffer{}
+		require.NoError(t, writeTar(context.TODO(), fs, buf, opts))
+		var out []string
+		tr := tar.NewReader(buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			out = append(out, hdr.Name)
+		}
+		return out
+	}
+
+	// empty chains collapse recursively, populated dirs stay
+	pruned := names(writeTarOpts{pruneEmptyDirs: true})
+	require.NotContains(t, pruned, "empty/")
+	require.NotContains(t, pruned, "empty/nested/")
+	require.NotContains(t, pruned, "mnt/")
+	require.Contains(t, pruned, "full/")
+	require.Contains(t, pruned, "full/f")
+
+	// the keep-list preserves explicitly needed empty dirs
+	kept := names(writeTarOpts{pruneEmptyDirs: true, keepEmptyDirs: []string{"mnt"}})
+	require.Contains(t, kept, "mnt/")
+	require.NotContains(t, kept, "empty/")
+}
+
+func TestWriteTarSizeLimits(t *testing.T) {
+	fs := newTestFS(t)
+
+	err := writeTar(context.TODO(), fs, io.Discard, writeTarOpts{maxFileSize: 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), maxFileSizeKey)
+	require.Contains(t, err.Error(), "aa.txt")
+
+	err = writeTar(context.TODO(), fs, io.Discard, writeTarOpts{maxTotalSize: 3})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), maxTotalSizeKey)
+
+	// generous limits pass
+	require.NoError(t, writeTar(context.TODO(), fs, io.Discard, writeTarOpts{maxFileSize: 1 << 20, maxTotalSize: 1 << 20}))
+}
+
+func TestWriteTarOwnerNames(t *testing.T) {
+	fs := newTestFS(t)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{
+		defaultUname: "builder",
+		defaultGname: "builder",
+		unameMap:     map[int]string{0: "root"},
+	}))
+
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Uid == 0 {
+			require.Equal(t, "root", hdr.Uname)
+		} else {
+			require.Equal(t, "builder", hdr.Uname)
+		}
+		require.Equal(t, "builder", hdr.Gname)
+	}
+}
+
+func TestWriteTarBlockingFactor(t *testing.T) {
+	fs := newTestFS(t)
+
+	const recordSize = 10240
+	plain := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, plain, writeTarOpts{}))
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{recordSize: recordSize}))
+
+	// the padded archive is the plain one followed by zero bytes up to the
+	// record boundary
+	require.Zero(t, buf.Len()%recordSize)
+	require.Greater(t, buf.Len(), plain.Len())
+	require.Equal(t, plain.Bytes(), buf.Bytes()[:plain.Len()])
+	require.Equal(t, bytes.Repeat([]byte{0}, buf.Len()-plain.Len()), buf.Bytes()[plain.Len():])
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{"aa.txt", "sub/", "sub/file", "zz.txt"}, names)
+}
+
+func TestWriteTarPreserveCaps(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "ping")
+	require.NoError(t, os.WriteFile(p, []byte("elf"), 0755))
+	// VFS_CAP_REVISION_2 blob with CAP_NET_RAW permitted and effective
+	capData := []byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	if err := unix.Setxattr(p, "security.capability", capData, 0); err != nil {
+		t.Skipf("cannot set file capabilities: %v", err)
+	}
+	require.NoError(t, unix.Setxattr(p, "user.other", []byte("x"), 0))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{preserveCaps: true}))
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, "ping", hdr.Name)
+	require.Equal(t, string(capData), hdr.PAXRecords["SCHILY.xattr.security.capability"])
+	// only the capability attribute is carried, not every xattr
+	require.NotContains(t, hdr.PAXRecords, "SCHILY.xattr.user.other")
+}
+
+func TestWriteTarChmod(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data.txt"), []byte("x"), 0644))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	// the later rule wins for entries matched by both
+	rules, err := parseChmodRules("**/*.sh=0755,run.sh=0700")
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{chmodRules: rules}))
+
+	modes := map[string]int64{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		modes[hdr.Name] = hdr.Mode & 07777
+	}
+	require.Equal(t, int64(0700), modes["run.sh"])
+	require.Equal(t, int64(0644), modes["data.txt"])
+}
+
+func TestWriteTarBrokenSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "target.txt"), []byte("x"), 0644))
+	require.NoError(t, os.Symlink("target.txt", filepath.Join(dir, "good")))
+	require.NoError(t, os.Symlink("missing", filepath.Join(dir, "dangling")))
+	fs := fsutil.NewFS(dir, &fsutil.WalkOpt{})
+
+	// keep and warn both export the link untouched
+	for _, mode := range []string{"", brokenSymlinksKeep, brokenSymlinksWarn} {
+		buf := &bytes.Buffer{}
+		require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{brokenSymlinks: mode}))
+	}
+
+	err := writeTar(context.TODO(), fs, &bytes.Buffer{}, writeTarOpts{brokenSymlinks: brokenSymlinksError})
+	require.ErrorContains(t, err, "broken symlink dangling -> missing")
+
+	// an out-of-tree absolute target is dangling as well
+	require.NoError(t, os.Remove(filepath.Join(dir, "dangling")))
+	require.NoError(t, os.Symlink("/etc/passwd", filepath.Join(dir, "escape")))
+	err = writeTar(context.TODO(), fs, &bytes.Buffer{}, writeTarOpts{brokenSymlinks: brokenSymlinksError})
+	require.ErrorContains(t, err, "broken symlink escape")
+}
@@ -0,0 +1,68 @@
+package local
+
+import (
+	"archive/tar"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// tarVerifier consumes a tee of the produced tar stream and re-parses it,
+// confirming that every header decodes and that the archive terminates
+// cleanly, so a corrupted artifact fails the export instead of being
+// delivered. The stream is checked before compression, concurrently with
+// the transfer, through a pipe.
+type tarVerifier struct {
+	pw      *io.PipeWriter
+	done    chan struct{}
+	entries int64
+	err     error
+}
+
+func newTarVerifier() *tarVerifier {
+	pr, pw := io.Pipe()
+	v := &tarVerifier{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(v.done)
+		tr := tar.NewReader(pr)
+		for {
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				v.err = err
+				pr.CloseWithError(err)
+				return
+			}
+			v.entries++
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				v.err = err
+				pr.CloseWithError(err)
+				return
+			}
+		}
+		// consume the trailing zero blocks so a truncated or overlong
+		// termination is noticed
+		if _, err := io.Copy(io.Discard, pr); err != nil {
+			v.err = err
+		}
+	}()
+	return v
+}
+
+func (v *tarVerifier) Write(p []byte) (int, error) {
+	return v.pw.Write(p)
+}
+
+// finish closes the verifier's side of the pipe and waits for the parse to
+// complete, returning the number of verified entries. werr, when non-nil,
+// aborts verification without reporting a verification error of its own.
+func (v *tarVerifier) finish(werr error) (int64, error) {
+	v.pw.CloseWithError(werr)
+	<-v.done
+	if werr != nil {
+		return v.entries, nil
+	}
+	return v.entries, errors.Wrap(v.err, "tar verification failed")
+}
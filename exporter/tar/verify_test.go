@@ -0,0 +1,40 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarVerifier(t *testing.T) {
+	fs := newTestFS(t)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{}))
+
+	tv := newTarVerifier()
+	_, err := io.Copy(tv, buf)
+	require.NoError(t, err)
+	n, err := tv.finish(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), n) // sub/, sub/file, aa.txt, zz.txt
+
+	// corrupt a header byte and the verifier must catch it
+	buf.Reset()
+	require.NoError(t, writeTar(context.TODO(), fs, buf, writeTarOpts{}))
+	dt := buf.Bytes()
+	dt[148] ^= 0xff // checksum field of the first header
+	tv = newTarVerifier()
+	_, _ = io.Copy(tv, bytes.NewReader(dt))
+	_, err = tv.finish(nil)
+	require.ErrorContains(t, err, "tar verification failed")
+
+	// a truncated archive (missing termination) also fails
+	tv = newTarVerifier()
+	_, _ = io.Copy(tv, bytes.NewReader(dt[:1024]))
+	_, err = tv.finish(nil)
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package epoch
 
 import (
+	"math"
 	"strconv"
 	"time"
 
@@ -13,6 +14,10 @@ const (
 	frontendSourceDateEpochArg = "build-arg:SOURCE_DATE_EPOCH"
 
 	KeySourceDateEpoch = "source-date-epoch"
+
+	// KeySourceDateEpochNanos is like KeySourceDateEpoch but in unix
+	// nanoseconds, for consumers that need sub-second determinism.
+	KeySourceDateEpochNanos = "source-date-epoch-nanos"
 )
 
 func ParseBuildArgs(opt map[string]string) (string, bool) {
@@ -25,25 +30,41 @@ func ParseExporterAttrs(opt map[string]string) (*time.Time, map[string]string, e
 
 	var tm *time.Time
 
+	var tmNanos *time.Time
+
 	for k, v := range opt {
 		switch k {
 		case KeySourceDateEpoch:
 			var err error
-			tm, err = parseTime(k, v)
+			tm, err = ParseTime(k, v)
 			if err != nil {
 				return nil, nil, err
 			}
+		case KeySourceDateEpochNanos:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid %s: %s", KeySourceDateEpochNanos, v)
+			}
+			t := time.Unix(0, n)
+			tmNanos = &t
 		default:
 			rest[k] = v
 		}
 	}
 
+	if tmNanos != nil {
+		if tm != nil && !tm.Equal((*tmNanos).Truncate(time.Second)) {
+			return nil, nil, errors.Errorf("conflicting %s and %s", KeySourceDateEpoch, KeySourceDateEpochNanos)
+		}
+		tm = tmNanos
+	}
+
 	return tm, rest, nil
 }
 
 func ParseSource(inp *exporter.Source) (*time.Time, bool, error) {
 	if v, ok := inp.Metadata[exptypes.ExporterEpochKey]; ok {
-		epoch, err := parseTime("", string(v))
+		epoch, err := ParseTime("", string(v))
 		if err != nil {
 			return nil, false, errors.Wrapf(err, "invalid SOURCE_DATE_EPOCH from frontend: %q", v)
 		}
@@ -52,14 +73,26 @@ func ParseSource(inp *exporter.Source) (*time.Time, bool, error) {
 	return nil, false, nil
 }
 
-func parseTime(key, value string) (*time.Time, error) {
+// ParseTime parses an epoch value, accepting unix seconds (optionally with
+// a fractional part) or an RFC3339 timestamp.
+func ParseTime(key, value string) (*time.Time, error) {
 	if value == "" {
 		return nil, nil
 	}
 	sde, err := strconv.ParseInt(value, 10, 64)
-	if err != nil {
-		return nil, errors.Wrapf(err, "invalid %s: %s", key, err)
+	if err == nil {
+		tm := time.Unix(sde, 0)
+		return &tm, nil
+	}
+	if f, err2 := strconv.ParseFloat(value, 64); err2 == nil {
+		sec, frac := math.Modf(f)
+		tm := time.Unix(int64(sec), int64(frac*float64(time.Second)))
+		return &tm, nil
+	}
+	// not unix seconds; fall back to RFC3339 (git, CI logs)
+	tm, err2 := time.Parse(time.RFC3339Nano, value)
+	if err2 != nil {
+		return nil, errors.Errorf("invalid %s: %q is neither unix seconds (%v) nor RFC3339 (%v)", key, value, err, err2)
 	}
-	tm := time.Unix(sde, 0)
 	return &tm, nil
 }
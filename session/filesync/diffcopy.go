@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"context"
 	io "io"
+	gofs "io/fs"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/moby/buildkit/util/bklog"
@@ -13,6 +15,7 @@ import (
 	"github.com/tonistiigi/fsutil"
 	fstypes "github.com/tonistiigi/fsutil/types"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type Stream interface {
@@ -42,6 +45,26 @@ func (bwc *bufferedWriteCloser) Close() error {
 	return bwc.Closer.Close()
 }
 
+// skipWriter discards the first remaining bytes written to it before
+// forwarding to the underlying writer. It lets a resumed transfer replay
+// the stream from the start while only sending what the receiver is
+// missing.
+type skipWriter struct {
+	io.WriteCloser
+	remaining int64
+}
+
+func (w *skipWriter) Write(p []byte) (int, error) {
+	if w.remaining >= int64(len(p)) {
+		w.remaining -= int64(len(p))
+		return len(p), nil
+	}
+	skip := int(w.remaining)
+	w.remaining = 0
+	n, err := w.WriteCloser.Write(p[skip:])
+	return skip + n, err
+}
+
 type streamWriterCloser struct {
 	grpc.ClientStream
 }
@@ -98,11 +121,11 @@ func recvDiffCopy(ds grpc.ClientStream, dest string, cu CacheUpdater, progress p
 	}))
 }
 
-func syncTargetDiffCopy(ds grpc.ServerStream, dest string) error {
+func syncTargetDiffCopy(ds Stream, dest string) error {
 	if err := os.MkdirAll(dest, 0700); err != nil {
 		return errors.Wrapf(err, "failed to create synctarget dest dir %s", dest)
 	}
-	return errors.WithStack(fsutil.Receive(ds.Context(), ds, dest, fsutil.ReceiveOpt{
+	if err := fsutil.Receive(ds.Context(), ds, dest, fsutil.ReceiveOpt{
 		Merge: true,
 		Filter: func() func(string, *fstypes.Stat) bool {
 			uid := os.Getuid()
@@ -113,7 +136,36 @@ func syncTargetDiffCopy(ds grpc.ServerStream, dest string) error {
 				return true
 			}
 		}(),
-	}))
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	if md, ok := metadata.FromIncomingContext(ds.Context()); ok && len(md.Get(keyDirSync)) > 0 {
+		return syncReceivedDir(dest)
+	}
+	return nil
+}
+
+// syncReceivedDir fsyncs every file and directory under dest, providing the
+// durability barrier requested through keyDirSync. Symlinks are skipped as
+// they cannot be opened for syncing.
+func syncReceivedDir(dest string) error {
+	return filepath.WalkDir(dest, func(p string, d gofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&gofs.ModeSymlink != 0 {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %s for sync", p)
+		}
+		err = f.Sync()
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		return errors.Wrapf(err, "failed to sync %s", p)
+	})
 }
 
 func writeTargetFile(ds grpc.ServerStream, wc io.WriteCloser) error {
@@ -0,0 +1,133 @@
+package filesync
+
+import (
+	"context"
+	io "io"
+	"os"
+
+	"github.com/moby/buildkit/session"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// FD sink targets let a same-host client hand the exporter a named pipe (or
+// any writable path, e.g. /proc/<pid>/fd/<n>) that the tar stream is written
+// into directly, skipping the filesync packet framing entirely. The path is
+// advertised through the dedicated FileSendFD service: the client's handler
+// reports it in the response header and then blocks as a completion signal
+// while the server writes the file out of band.
+
+// keyFDSinkPath is the gRPC header with which an FD sink target reports the
+// path the sender should write into.
+const keyFDSinkPath = "fd-sink-path"
+
+// NewFSSyncTargetFD allows writing directly into the named pipe or file at
+// path, which must already exist and be writable by the build daemon. Only
+// meaningful when client and daemon share a filesystem.
+func NewFSSyncTargetFD(path string) session.Attachable {
+	p := &fsSyncTarget{
+		fdpath: path,
+	}
+	return p
+}
+
+// SupportsFDSink reports whether the client attached an FD sink target with
+// NewFSSyncTargetFD.
+func SupportsFDSink(c session.Caller) bool {
+	return c.Supports(session.MethodURL(_FileSendFD_serviceDesc.ServiceName, "diffcopy"))
+}
+
+// CopyFileFD opens a writer onto the path advertised by the client's FD sink
+// target. The gRPC stream carries no data; it is held open until Close so
+// the client knows when the out-of-band write has finished. Callers must
+// check SupportsFDSink first.
+func CopyFileFD(ctx context.Context, c session.Caller) (io.WriteCloser, error) {
+	method := session.MethodURL(_FileSendFD_serviceDesc.ServiceName, "diffcopy")
+	if !c.Supports(method) {
+		return nil, errors.Errorf("method %s not supported by the client", method)
+	}
+
+	stream, err := c.Conn().NewStream(ctx, &_FileSendFD_serviceDesc.Streams[0], "/"+_FileSendFD_serviceDesc.ServiceName+"/DiffCopy")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	hdr, err := stream.Header()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	v := hdr.Get(keyFDSinkPath)
+	if len(v) == 0 {
+		return nil, errors.Errorf("fd sink target did not report %s", keyFDSinkPath)
+	}
+	f, err := os.OpenFile(v[0], os.O_WRONLY, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open fd sink %s", v[0])
+	}
+	return &fdSinkWriter{f: f, stream: stream}, nil
+}
+
+type fdSinkWriter struct {
+	f      *os.File
+	stream grpc.ClientStream
+}
+
+func (w *fdSinkWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *fdSinkWriter) Close() error {
+	err := w.f.Close()
+	if err1 := w.stream.CloseSend(); err == nil {
+		err = errors.WithStack(err1)
+	}
+	// wait for the client handler to return so completion is observed on
+	// both sides
+	if err1 := w.stream.RecvMsg(&BytesMessage{}); err == nil && err1 != io.EOF {
+		err = errors.WithStack(err1)
+	}
+	return err
+}
+
+// _FileSendFD_serviceDesc mirrors the FileSend service with a separate name,
+// so the FD sink capability can be advertised per session without changing
+// the FileSend protocol itself.
+var _FileSendFD_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "moby.filesync.v1.FileSendFD",
+	HandlerType: (*FileSendServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "DiffCopy",
+			Handler:       _FileSendFD_DiffCopy_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "filesync.proto",
+}
+
+func _FileSendFD_DiffCopy_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(*fsSyncTarget).fdDiffCopy(&fileSendDiffCopyServer{stream})
+}
+
+func (sp *fsSyncTarget) fdDiffCopy(stream FileSend_DiffCopyServer) error {
+	if sp.fdpath == "" {
+		return errors.New("fd sink not configured")
+	}
+	if err := stream.SendHeader(metadata.Pairs(keyFDSinkPath, sp.fdpath)); err != nil {
+		return errors.WithStack(err)
+	}
+	// the data bypasses the stream; block until the sender closes it to
+	// signal that the out-of-band write is complete
+	for {
+		var bm BytesMessage
+		if err := stream.RecvMsg(&bm); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	io "io"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/moby/buildkit/session"
@@ -24,6 +25,16 @@ const (
 	keyFollowPaths        = "followpaths"
 	keyDirName            = "dir-name"
 	keyExporterMetaPrefix = "exporter-md-"
+
+	// keyResumeOffset is the gRPC header with which a resumable file send
+	// target reports how many bytes it already holds from an interrupted
+	// transfer.
+	keyResumeOffset = "resume-offset"
+
+	// keyDirSync is the gRPC metadata key with which a directory sender
+	// asks the receiving target to fsync the written files before
+	// acknowledging completion.
+	keyDirSync = "dir-sync"
 )
 
 type fsSyncProvider struct {
@@ -247,13 +258,37 @@ func NewFSSyncTarget(f func(map[string]string) (io.WriteCloser, error)) session.
 	return p
 }
 
+// NewFSSyncTargetResumable is like NewFSSyncTarget but supports resuming an
+// interrupted transfer. In addition to the writer, f returns the byte offset
+// already received for the target; a reconnecting sender skips that prefix
+// instead of retransmitting it.
+func NewFSSyncTargetResumable(f func(map[string]string) (io.WriteCloser, int64, error)) session.Attachable {
+	p := &fsSyncTarget{
+		fr: f,
+	}
+	return p
+}
+
 type fsSyncTarget struct {
 	outdir string
+	fdpath string
 	f      func(map[string]string) (io.WriteCloser, error)
+	fr     func(map[string]string) (io.WriteCloser, int64, error)
 }
 
 func (sp *fsSyncTarget) Register(server *grpc.Server) {
 	RegisterFileSendServer(server, sp)
+	if sp.fr != nil {
+		server.RegisterService(&_FileSendResumable_serviceDesc, sp)
+	}
+	if sp.outdir != "" {
+		// directory targets can transparently decompress per-file wire
+		// compression
+		server.RegisterService(&_FileSendCompressed_serviceDesc, sp)
+	}
+	if sp.fdpath != "" {
+		server.RegisterService(&_FileSendFD_serviceDesc, sp)
+	}
 }
 
 func (sp *fsSyncTarget) DiffCopy(stream FileSend_DiffCopyServer) (err error) {
@@ -264,30 +299,69 @@ func (sp *fsSyncTarget) DiffCopy(stream FileSend_DiffCopyServer) (err error) {
 	if sp.f == nil {
 		return errors.New("empty outfile and outdir")
 	}
-	opts, _ := metadata.FromIncomingContext(stream.Context()) // if no metadata continue with empty object
-	md := map[string]string{}
-	for k, v := range opts {
-		if strings.HasPrefix(k, keyExporterMetaPrefix) {
-			md[strings.TrimPrefix(k, keyExporterMetaPrefix)] = strings.Join(v, ",")
+	wc, err := sp.f(exporterMeta(stream.Context()))
+	if err != nil {
+		return err
+	}
+	if wc == nil {
+		return status.Errorf(codes.AlreadyExists, "target already exists")
+	}
+	defer func() {
+		err1 := wc.Close()
+		if err != nil {
+			err = err1
 		}
+	}()
+	return writeTargetFile(stream, wc)
+}
+
+func (sp *fsSyncTarget) resumableDiffCopy(stream FileSend_DiffCopyServer) (err error) {
+	if sp.fr == nil {
+		return errors.New("resumable transfer not configured")
 	}
-	wc, err := sp.f(md)
+	wc, offset, err := sp.fr(exporterMeta(stream.Context()))
 	if err != nil {
 		return err
 	}
 	if wc == nil {
 		return status.Errorf(codes.AlreadyExists, "target already exists")
 	}
+	// report the checkpoint before consuming the stream so the sender
+	// knows how much of the replayed stream to skip
+	if err := stream.SendHeader(metadata.Pairs(keyResumeOffset, strconv.FormatInt(offset, 10))); err != nil {
+		return errors.WithStack(err)
+	}
 	defer func() {
 		err1 := wc.Close()
-		if err != nil {
+		if err == nil {
 			err = err1
 		}
 	}()
 	return writeTargetFile(stream, wc)
 }
 
+// exporterMeta extracts exporter metadata from incoming gRPC metadata. If
+// there is no metadata it returns an empty map.
+func exporterMeta(ctx context.Context) map[string]string {
+	opts, _ := metadata.FromIncomingContext(ctx)
+	md := map[string]string{}
+	for k, v := range opts {
+		if strings.HasPrefix(k, keyExporterMetaPrefix) {
+			md[strings.TrimPrefix(k, keyExporterMetaPrefix)] = strings.Join(v, ",")
+		}
+	}
+	return md
+}
+
 func CopyToCaller(ctx context.Context, fs fsutil.FS, c session.Caller, progress func(int, bool)) error {
+	if SupportsWireCompression(c) {
+		stream, err := c.Conn().NewStream(ctx, &_FileSendCompressed_serviceDesc.Streams[0], "/"+_FileSendCompressed_serviceDesc.ServiceName+"/DiffCopy")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return sendDiffCopy(&compressStream{Stream: &fileSendDiffCopyClient{stream}}, fs, progress)
+	}
+
 	method := session.MethodURL(_FileSend_serviceDesc.ServiceName, "diffcopy")
 	if !c.Supports(method) {
 		return errors.Errorf("method %s not supported by the client", method)
@@ -303,6 +377,16 @@ func CopyToCaller(ctx context.Context, fs fsutil.FS, c session.Caller, progress
 	return sendDiffCopy(cc, fs, progress)
 }
 
+// CopyToCallerSynced is CopyToCaller with a durability barrier: the
+// receiving directory target fsyncs everything it wrote before the
+// transfer is acknowledged, so files are on disk - not just in the page
+// cache - when this returns. Old clients ignore the request and behave
+// like plain CopyToCaller.
+func CopyToCallerSynced(ctx context.Context, fs fsutil.FS, c session.Caller, progress func(int, bool)) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, keyDirSync, "1")
+	return CopyToCaller(ctx, fs, c, progress)
+}
+
 func CopyFileWriter(ctx context.Context, md map[string]string, c session.Caller) (io.WriteCloser, error) {
 	method := session.MethodURL(_FileSend_serviceDesc.ServiceName, "diffcopy")
 	if !c.Supports(method) {
@@ -326,6 +410,118 @@ func CopyFileWriter(ctx context.Context, md map[string]string, c session.Caller)
 	return newStreamWriter(cc), nil
 }
 
+// CopyFileWriterWithProgress is like CopyFileWriter but invokes progress
+// with the cumulative number of bytes written as data flows, and a final
+// time with last set once the writer is closed. It gives embedders a
+// programmatic hook without subscribing to the progress channel. A nil
+// progress behaves exactly like CopyFileWriter.
+func CopyFileWriterWithProgress(ctx context.Context, md map[string]string, c session.Caller, progress func(int, bool)) (io.WriteCloser, error) {
+	w, err := CopyFileWriter(ctx, md, c)
+	if err != nil || progress == nil {
+		return w, err
+	}
+	return &progressWriteCloser{WriteCloser: w, progress: progress}, nil
+}
+
+type progressWriteCloser struct {
+	io.WriteCloser
+	progress func(int, bool)
+	n        int
+	done     bool
+}
+
+func (w *progressWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.n += n
+		w.progress(w.n, false)
+	}
+	return n, err
+}
+
+func (w *progressWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	if !w.done {
+		w.done = true
+		w.progress(w.n, true)
+	}
+	return err
+}
+
+// SupportsResume reports whether the client session attached a resumable
+// file send target.
+func SupportsResume(c session.Caller) bool {
+	return c.Supports(session.MethodURL(_FileSendResumable_serviceDesc.ServiceName, "diffcopy"))
+}
+
+// CopyFileWriterResumable is like CopyFileWriter for clients that attached a
+// target with NewFSSyncTargetResumable. The receiver reports how many bytes
+// it already holds from a previous attempt and the returned writer silently
+// discards that prefix, so the caller replays the stream from the beginning
+// either way. The reported offset is returned for accounting. Callers must
+// check SupportsResume first and fall back to CopyFileWriter, which
+// retransmits the whole stream.
+func CopyFileWriterResumable(ctx context.Context, md map[string]string, c session.Caller) (io.WriteCloser, int64, error) {
+	method := session.MethodURL(_FileSendResumable_serviceDesc.ServiceName, "diffcopy")
+	if !c.Supports(method) {
+		return nil, 0, errors.Errorf("method %s not supported by the client", method)
+	}
+
+	opts := make(map[string][]string, len(md))
+	for k, v := range md {
+		opts[keyExporterMetaPrefix+k] = []string{v}
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, opts)
+
+	stream, err := c.Conn().NewStream(ctx, &_FileSendResumable_serviceDesc.Streams[0], "/"+_FileSendResumable_serviceDesc.ServiceName+"/DiffCopy")
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	cc := &fileSendDiffCopyClient{stream}
+
+	hdr, err := cc.Header()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	var offset int64
+	if v := hdr.Get(keyResumeOffset); len(v) > 0 {
+		offset, err = strconv.ParseInt(v[0], 10, 64)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "invalid %s header: %s", keyResumeOffset, v[0])
+		}
+	}
+
+	w := newStreamWriter(cc)
+	if offset > 0 {
+		w = &skipWriter{WriteCloser: w, remaining: offset}
+	}
+	return w, offset, nil
+}
+
+// _FileSendResumable_serviceDesc mirrors the FileSend service with a
+// hand-written descriptor. It is registered only by resumable targets, so
+// its presence in the session's method list doubles as the capability
+// check for resume support.
+var _FileSendResumable_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "moby.filesync.v1.FileSendResumable",
+	HandlerType: (*FileSendServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "DiffCopy",
+			Handler:       _FileSendResumable_DiffCopy_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "filesync.proto",
+}
+
+func _FileSendResumable_DiffCopy_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(*fsSyncTarget).resumableDiffCopy(&fileSendDiffCopyServer{stream})
+}
+
 type InvalidSessionError struct {
 	err error
 }
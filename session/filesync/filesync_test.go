@@ -1,15 +1,20 @@
 package filesync
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/session/testutil"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -70,3 +75,365 @@ func TestFileSyncIncludePatterns(t *testing.T) {
 	err = g.Wait()
 	require.NoError(t, err)
 }
+
+func TestCopyFileWriterResume(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+
+	// target that drops the connection after receiving part of the
+	// stream on the first attempt, keeping what it already received
+	target := &resumeTarget{failAfter: 4000}
+
+	s, err := session.NewSession(ctx, "foo", "bar")
+	require.NoError(t, err)
+
+	m, err := session.NewManager()
+	require.NoError(t, err)
+
+	s.Allow(NewFSSyncTargetResumable(target.open))
+
+	dialer := session.Dialer(testutil.TestStream(testutil.Handler(m.HandleConn)))
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	g.Go(func() error {
+		return s.Run(ctx, dialer)
+	})
+
+	g.Go(func() error {
+		defer s.Close()
+
+		c, err := m.Get(ctx, s.ID(), false)
+		if err != nil {
+			return err
+		}
+		if !SupportsResume(c) {
+			return errors.New("resume not supported")
+		}
+
+		w, offset, err := CopyFileWriterResumable(ctx, nil, c)
+		if err != nil {
+			return err
+		}
+		if offset != 0 {
+			return errors.Errorf("unexpected initial offset %d", offset)
+		}
+
+		// the target drops the stream mid-transfer; the error may
+		// surface on Write or on Close depending on buffering
+		_, werr := w.Write(payload)
+		cerr := w.Close()
+		if werr == nil && cerr == nil {
+			return errors.New("expected interrupted transfer to fail")
+		}
+
+		received := target.received()
+		if received == 0 || received >= int64(len(payload)) {
+			return errors.Errorf("unexpected checkpoint %d", received)
+		}
+
+		w, offset, err = CopyFileWriterResumable(ctx, nil, c)
+		if err != nil {
+			return err
+		}
+		if offset != received {
+			return errors.Errorf("expected resume offset %d, got %d", received, offset)
+		}
+
+		// replay the full stream; only the missing suffix is sent
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		require.Equal(t, payload, target.bytes())
+		return nil
+	})
+
+	err = g.Wait()
+	require.NoError(t, err)
+}
+
+// resumeTarget records received bytes and fails the first transfer once
+// failAfter bytes have arrived, simulating a dropped connection.
+type resumeTarget struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	failAfter int64
+	failed    bool
+}
+
+func (rt *resumeTarget) open(map[string]string) (io.WriteCloser, int64, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return &resumeTargetWriter{rt: rt}, int64(rt.buf.Len()), nil
+}
+
+func (rt *resumeTarget) received() int64 {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return int64(rt.buf.Len())
+}
+
+func (rt *resumeTarget) bytes() []byte {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.buf.Bytes()
+}
+
+type resumeTargetWriter struct {
+	rt *resumeTarget
+}
+
+func (w *resumeTargetWriter) Write(p []byte) (int, error) {
+	rt := w.rt
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if !rt.failed {
+		if remain := rt.failAfter - int64(rt.buf.Len()); remain < int64(len(p)) {
+			rt.buf.Write(p[:remain])
+			rt.failed = true
+			return int(remain), errors.New("connection dropped")
+		}
+	}
+	return rt.buf.Write(p)
+}
+
+func (w *resumeTargetWriter) Close() error {
+	return nil
+}
+
+func TestCopyFileWriterWithProgress(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+	)
+	s, err := session.NewSession(ctx, "foo", "bar")
+	require.NoError(t, err)
+
+	m, err := session.NewManager()
+	require.NoError(t, err)
+
+	s.Allow(NewFSSyncTarget(func(map[string]string) (io.WriteCloser, error) {
+		return &nopWriteCloser{Writer: &lockedWriter{mu: &mu, w: &buf}}, nil
+	}))
+
+	dialer := session.Dialer(testutil.TestStream(testutil.Handler(m.HandleConn)))
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	g.Go(func() error {
+		return s.Run(ctx, dialer)
+	})
+
+	var calls []int
+	var lastSeen bool
+
+	g.Go(func() error {
+		defer s.Close()
+
+		c, err := m.Get(ctx, s.ID(), false)
+		if err != nil {
+			return err
+		}
+
+		w, err := CopyFileWriterWithProgress(ctx, nil, c, func(n int, last bool) {
+			calls = append(calls, n)
+			if last {
+				lastSeen = true
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+
+	require.NoError(t, g.Wait())
+
+	require.NotEmpty(t, calls)
+	require.Equal(t, len(payload), calls[len(calls)-1])
+	require.True(t, lastSeen)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, payload, buf.Bytes())
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func TestCopyToCallerWireCompression(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "big"), bytes.Repeat([]byte("abcd"), 1<<18), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "small"), []byte("content"), 0600))
+
+	s, err := session.NewSession(ctx, "foo", "bar")
+	require.NoError(t, err)
+
+	m, err := session.NewManager()
+	require.NoError(t, err)
+
+	s.Allow(NewFSSyncTargetDir(destDir))
+
+	dialer := session.Dialer(testutil.TestStream(testutil.Handler(m.HandleConn)))
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	g.Go(func() error {
+		return s.Run(ctx, dialer)
+	})
+
+	g.Go(func() error {
+		c, err := m.Get(ctx, s.ID(), false)
+		if err != nil {
+			return err
+		}
+		// directory targets advertise the compressed variant
+		require.True(t, SupportsWireCompression(c))
+		if err := CopyToCaller(ctx, fsutil.NewFS(srcDir, &fsutil.WalkOpt{}), c, nil); err != nil {
+			return err
+		}
+
+		dt, err := os.ReadFile(filepath.Join(destDir, "big"))
+		if err != nil {
+			return err
+		}
+		require.Equal(t, bytes.Repeat([]byte("abcd"), 1<<18), dt)
+		dt, err = os.ReadFile(filepath.Join(destDir, "small"))
+		if err != nil {
+			return err
+		}
+		require.Equal(t, "content", string(dt))
+		return s.Close()
+	})
+
+	require.NoError(t, g.Wait())
+}
+
+func TestCopyFileFD(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+
+	sink := filepath.Join(t.TempDir(), "out.tar")
+	require.NoError(t, os.WriteFile(sink, nil, 0600))
+
+	s, err := session.NewSession(ctx, "foo", "bar")
+	require.NoError(t, err)
+
+	m, err := session.NewManager()
+	require.NoError(t, err)
+
+	s.Allow(NewFSSyncTargetFD(sink))
+
+	dialer := session.Dialer(testutil.TestStream(testutil.Handler(m.HandleConn)))
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	g.Go(func() error {
+		return s.Run(ctx, dialer)
+	})
+
+	g.Go(func() error {
+		c, err := m.Get(ctx, s.ID(), false)
+		if err != nil {
+			return err
+		}
+		require.True(t, SupportsFDSink(c))
+		w, err := CopyFileFD(ctx, c)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("tar bytes")); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		dt, err := os.ReadFile(sink)
+		if err != nil {
+			return err
+		}
+		require.Equal(t, "tar bytes", string(dt))
+		return s.Close()
+	})
+
+	require.NoError(t, g.Wait())
+}
+
+func TestCopyToCallerSynced(t *testing.T) {
+	ctx := context.TODO()
+	t.Parallel()
+
+	srcDir := t.TempDir()
+	destDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "file"), []byte("content"), 0600))
+
+	s, err := session.NewSession(ctx, "foo", "bar")
+	require.NoError(t, err)
+
+	m, err := session.NewManager()
+	require.NoError(t, err)
+
+	s.Allow(NewFSSyncTargetDir(destDir))
+
+	dialer := session.Dialer(testutil.TestStream(testutil.Handler(m.HandleConn)))
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	g.Go(func() error {
+		return s.Run(ctx, dialer)
+	})
+
+	g.Go(func() error {
+		c, err := m.Get(ctx, s.ID(), false)
+		if err != nil {
+			return err
+		}
+		if err := CopyToCallerSynced(ctx, fsutil.NewFS(srcDir, &fsutil.WalkOpt{}), c, nil); err != nil {
+			return err
+		}
+
+		// completion is only acknowledged after the target synced the files
+		dt, err := os.ReadFile(filepath.Join(destDir, "file"))
+		if err != nil {
+			return err
+		}
+		require.Equal(t, "content", string(dt))
+		return s.Close()
+	})
+
+	require.NoError(t, g.Wait())
+}
@@ -18,6 +18,9 @@ type Caller interface {
 	Conn() *grpc.ClientConn
 	Name() string
 	SharedKey() string
+	// HostPlatform returns the os/arch the client reported for its own
+	// host, or an empty string for clients that predate the header.
+	HostPlatform() string
 }
 
 type client struct {
@@ -108,6 +111,7 @@ func (sm *Manager) handleConn(ctx context.Context, conn net.Conn, opts map[strin
 	id := h.Get(headerSessionID)
 	name := h.Get(headerSessionName)
 	sharedKey := h.Get(headerSessionSharedKey)
+	hostPlatform := h.Get(headerSessionHostPlatform)
 
 	ctx, cc, err := grpcClientConn(ctx, conn)
 	if err != nil {
@@ -117,12 +121,13 @@ func (sm *Manager) handleConn(ctx context.Context, conn net.Conn, opts map[strin
 
 	c := &client{
 		Session: Session{
-			id:        id,
-			name:      name,
-			sharedKey: sharedKey,
-			ctx:       ctx,
-			cancelCtx: cancel,
-			done:      make(chan struct{}),
+			id:           id,
+			name:         name,
+			sharedKey:    sharedKey,
+			hostPlatform: hostPlatform,
+			ctx:          ctx,
+			cancelCtx:    cancel,
+			done:         make(chan struct{}),
 		},
 		cc:        cc,
 		supported: make(map[string]struct{}),
@@ -205,6 +210,10 @@ func (c *client) SharedKey() string {
 	return c.sharedKey
 }
 
+func (c *client) HostPlatform() string {
+	return c.hostPlatform
+}
+
 func (c *client) Supports(url string) bool {
 	_, ok := c.supported[strings.ToLower(url)]
 	return ok
@@ -3,6 +3,7 @@ package session
 import (
 	"context"
 	"net"
+	"runtime"
 	"strings"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -18,10 +19,11 @@ import (
 )
 
 const (
-	headerSessionID        = "X-Docker-Expose-Session-Uuid"
-	headerSessionName      = "X-Docker-Expose-Session-Name"
-	headerSessionSharedKey = "X-Docker-Expose-Session-Sharedkey"
-	headerSessionMethod    = "X-Docker-Expose-Session-Grpc-Method"
+	headerSessionID           = "X-Docker-Expose-Session-Uuid"
+	headerSessionName         = "X-Docker-Expose-Session-Name"
+	headerSessionSharedKey    = "X-Docker-Expose-Session-Sharedkey"
+	headerSessionMethod       = "X-Docker-Expose-Session-Grpc-Method"
+	headerSessionHostPlatform = "X-Docker-Expose-Session-Hostplatform"
 )
 
 var propagators = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
@@ -36,14 +38,15 @@ type Attachable interface {
 
 // Session is a long running connection between client and a daemon
 type Session struct {
-	id         string
-	name       string
-	sharedKey  string
-	ctx        context.Context
-	cancelCtx  func()
-	done       chan struct{}
-	grpcServer *grpc.Server
-	conn       net.Conn
+	id           string
+	name         string
+	sharedKey    string
+	hostPlatform string
+	ctx          context.Context
+	cancelCtx    func()
+	done         chan struct{}
+	grpcServer   *grpc.Server
+	conn         net.Conn
 }
 
 // NewSession returns a new long running session
@@ -76,10 +79,11 @@ func NewSession(ctx context.Context, name, sharedKey string) (*Session, error) {
 	}
 
 	s := &Session{
-		id:         id,
-		name:       name,
-		sharedKey:  sharedKey,
-		grpcServer: grpc.NewServer(serverOpts...),
+		id:           id,
+		name:         name,
+		sharedKey:    sharedKey,
+		hostPlatform: runtime.GOOS + "/" + runtime.GOARCH,
+		grpcServer:   grpc.NewServer(serverOpts...),
 	}
 
 	grpc_health_v1.RegisterHealthServer(s.grpcServer, health.NewServer())
@@ -110,6 +114,7 @@ func (s *Session) Run(ctx context.Context, dialer Dialer) error {
 	meta[headerSessionID] = []string{s.id}
 	meta[headerSessionName] = []string{s.name}
 	meta[headerSessionSharedKey] = []string{s.sharedKey}
+	meta[headerSessionHostPlatform] = []string{s.hostPlatform}
 
 	for name, svc := range s.grpcServer.GetServiceInfo() {
 		for _, method := range svc.Methods {
@@ -106,6 +106,40 @@ type Status struct {
 	Completed *time.Time
 }
 
+// ExportEvent is a typed progress value emitted by exporters alongside the
+// human-readable Status, for consumers that want machine-readable events
+// instead of parsing status strings. It is written under a separate id so
+// it never replaces a Status; readers that don't know the type skip it.
+type ExportEvent struct {
+	// Phase identifies the stage of the export, e.g. "export".
+	Phase string
+	// Platform is the platform being written, when attributable.
+	Platform   string
+	BytesDone  int64
+	BytesTotal int64
+	Done       bool
+}
+
+// ExportSummary is a typed progress value written once when an export
+// finishes, successful or not, so embedders can collect metrics without
+// scraping status strings. BytesWritten counts bytes on the wire and
+// BytesUncompressed the tar stream before compression; the two are equal
+// for uncompressed exports. PlatformBytes is filled when the export
+// tracks a per-platform breakdown.
+type ExportSummary struct {
+	Files             int64
+	BytesWritten      int64
+	BytesUncompressed int64
+	PlatformBytes     map[string]int64
+	CompressionRatio  float64
+	Duration          time.Duration
+	// VerifiedEntries is the number of tar members re-parsed by the
+	// exporter's opt-in verification pass; zero when verification is
+	// disabled.
+	VerifiedEntries int64
+	Error           string
+}
+
 type progressReader struct {
 	ctx     context.Context
 	cond    *sync.Cond